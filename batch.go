@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/shared"
+)
+
+// errNotInRegion is returned by verify-regions when a file has not reached the
+// region.
+var errNotInRegion = errors.New("file not in region")
+
+type loadtestUpload struct {
+	FileID  string  `json:"fileId,omitempty"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type loadtestResult struct {
+	Files        int              `json:"files"`
+	Failed       int              `json:"failed"`
+	Bytes        int64            `json:"bytes"`
+	Seconds      float64          `json:"seconds"`
+	MiBPerSecond float64          `json:"mibPerSecond"`
+	P50Seconds   float64          `json:"p50Seconds"`
+	P95Seconds   float64          `json:"p95Seconds"`
+	Uploads      []loadtestUpload `json:"uploads"`
+}
+
+func loadtestCommand(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags()
+	var dst destination
+	dst.register(flags, "DataOcean folder of the files (default a random one per file)")
+	n := flags.Int("n", 10, "number of uploads")
+	parallel := flags.Int("parallel", 4, "uploads running at once")
+	multipart := flags.Bool("multipart", false, "upload in parts even when the file is small")
+	bandwidth := byteSize(0)
+	flags.Var(&bandwidth, "bandwidth", "bytes per second shared by all uploads, such as 100MiB (default no cap)")
+	out := flags.String("csv", "", "write the id, duration and error of every upload to this CSV file")
+	err := parse(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *n < 1 || *parallel < 1 {
+		return usagef("loadtest: -n and -parallel must be at least 1")
+	}
+	service, err := c.service()
+	if err != nil {
+		return err
+	}
+	source := flags.Arg(0)
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	var csvFile *os.File
+	if *out != "" {
+		csvFile, err = os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer csvFile.Close()
+	}
+
+	// Every upload shares one Limiter so that together they stay within the
+	// bandwidth cap.
+	opts := c.options()
+	opts.AutoChunkSize = c.chunkSize == 0
+	opts.Limiter = shared.NewLimiter(int64(bandwidth), 0)
+	isMultipart := c.isMultipart(service, info.Size(), *multipart)
+	folder := dst.path
+
+	uploads := make([]loadtestUpload, *n)
+	var firstErr error
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, *parallel)
+	start := time.Now()
+	for i := range uploads {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// Every upload gets a random name so that they do not collide.
+			name := shared.GenerateRandomString(5) + filepath.Ext(source)
+			d := dst
+			if folder != "" {
+				d.path = strings.TrimSuffix(folder, "/") + "/" + name
+			}
+			uploadStart := time.Now()
+			fileId, err := uploadFile(ctx, service, d.payload(c, name, isMultipart), source, opts)
+			uploads[i] = loadtestUpload{FileID: fileId, Seconds: time.Since(uploadStart).Seconds()}
+			if err != nil {
+				uploads[i].Error = err.Error()
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	result := loadtestResult{Files: *n, Seconds: time.Since(start).Seconds(), Uploads: uploads}
+	var durations []float64
+	for _, u := range uploads {
+		if u.Error != "" {
+			result.Failed++
+			continue
+		}
+		result.Bytes += info.Size()
+		durations = append(durations, u.Seconds)
+	}
+	result.MiBPerSecond = float64(result.Bytes) / (1024 * 1024) / result.Seconds
+	result.P50Seconds = percentile(durations, 0.5)
+	result.P95Seconds = percentile(durations, 0.95)
+	if csvFile != nil {
+		err = writeLoadtestCSV(csvFile, uploads)
+		if err != nil {
+			return err
+		}
+	}
+	c.print(result, fmt.Sprintf("%d uploads, %d failed, %d bytes in %.1fs, %.1f MiB/s, p50 %.2fs, p95 %.2fs",
+		result.Files, result.Failed, result.Bytes, result.Seconds, result.MiBPerSecond, result.P50Seconds, result.P95Seconds))
+	if firstErr != nil {
+		return fmt.Errorf("%d of %d uploads failed, the first with: %w", result.Failed, result.Files, firstErr)
+	}
+	return nil
+}
+
+func uploadFile(ctx context.Context, service shared.Service, payload shared.Payload, path string, opts shared.UploadOptions) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return shared.UploadContext(ctx, service, payload, nil, file, opts)
+}
+
+// percentile returns the p-th percentile of values, or 0 when there are none.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted[int(p*float64(len(sorted)-1))]
+}
+
+// writeLoadtestCSV writes one row per upload, under a file_id header that
+// verify-regions skips.
+func writeLoadtestCSV(w io.Writer, uploads []loadtestUpload) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"file_id", "seconds", "error"})
+	for _, u := range uploads {
+		writer.Write([]string{u.FileID, strconv.FormatFloat(u.Seconds, 'f', 3, 64), u.Error})
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// readFileIds returns the first column of a CSV file, without the file_id
+// header and empty ids.
+func readFileIds(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var fileIds []string
+	for i, record := range records {
+		if record[0] == "" || (i == 0 && record[0] == "file_id") {
+			continue
+		}
+		fileIds = append(fileIds, record[0])
+	}
+	return fileIds, nil
+}
+
+type regionCheck struct {
+	FileID  string   `json:"fileId"`
+	Regions []string `json:"regions"`
+	OK      bool     `json:"ok"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func verifyRegionsCommand(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags()
+	region := flags.String("region", "eu1", "region every file must be in")
+	parallel := flags.Int("parallel", 5, "files checked at once")
+	err := parse(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *parallel < 1 {
+		return usagef("verify-regions: -parallel must be at least 1")
+	}
+	if c.backend != dataocean.ServiceName {
+		return usagef("verify-regions needs -backend %s", dataocean.ServiceName)
+	}
+	service, err := c.service()
+	if err != nil {
+		return err
+	}
+	do := service.(*dataocean.DataOcean)
+	fileIds, err := readFileIds(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	checks := make([]regionCheck, len(fileIds))
+	errs := make([]error, len(fileIds))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, *parallel)
+	for i, fileId := range fileIds {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, fileId string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			checks[i] = regionCheck{FileID: fileId}
+			file, err := do.StatContext(ctx, fileId)
+			if err != nil {
+				checks[i].Error = strings.TrimSpace(err.Error())
+				errs[i] = fmt.Errorf("file %s: %w", fileId, err)
+				return
+			}
+			checks[i].Regions = file.Regions
+			for _, r := range file.Regions {
+				if r == *region {
+					checks[i].OK = true
+					return
+				}
+			}
+			errs[i] = fmt.Errorf("file %s: %w %s", fileId, errNotInRegion, *region)
+		}(i, fileId)
+	}
+	wg.Wait()
+
+	var text strings.Builder
+	missing := 0
+	for _, check := range checks {
+		if check.OK {
+			continue
+		}
+		missing++
+		if check.Error != "" {
+			fmt.Fprintf(&text, "%s\t%s\n", check.FileID, check.Error)
+		} else {
+			fmt.Fprintf(&text, "%s\tin %s\n", check.FileID, strings.Join(check.Regions, ","))
+		}
+	}
+	fmt.Fprintf(&text, "%d of %d files in %s", len(checks)-missing, len(checks), *region)
+	c.print(map[string]interface{}{"region": *region, "files": checks}, text.String())
+	return errors.Join(errs...)
+}
+
+type sweptUpload struct {
+	ID        string                 `json:"id"`
+	State     string                 `json:"state"`
+	Parts     int                    `json:"parts"`
+	UpdatedAt time.Time              `json:"updatedAt"`
+	Source    string                 `json:"source"`
+	Service   shared.ServiceIdentity `json:"service"`
+}
+
+// sweepCommand lists the incomplete uploads journaled in -state-dir and,
+// unless -dry-run is set, aborts the stale ones and removes their journals.
+// Uploads started on another backend, environment or space are listed as
+// skipped and left alone.
+func sweepCommand(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags()
+	stateDir := flags.String("state-dir", ".", "directory holding upload journals")
+	olderThan := flags.Duration("older-than", 24*time.Hour, "sweep uploads without progress for this long")
+	dryRun := flags.Bool("dry-run", false, "only list the uploads")
+	err := parse(flags, args, 0, 0)
+	if err != nil {
+		return err
+	}
+	service, err := c.service()
+	if err != nil {
+		return err
+	}
+
+	journals, err := shared.ListJournals(*stateDir)
+	if err != nil {
+		return err
+	}
+	uploads := []sweptUpload{}
+	var stale []*shared.Journal
+	var text strings.Builder
+	for _, j := range journals {
+		state := "incomplete"
+		switch {
+		case !j.BelongsTo(service):
+			state = "skipped"
+		case j.Stale(*olderThan):
+			state = "stale"
+			stale = append(stale, j)
+		}
+		uploads = append(uploads, sweptUpload{ID: j.ID, State: state, Parts: len(j.Parts), UpdatedAt: j.UpdatedAt, Source: j.Source.Path, Service: j.Service})
+		fmt.Fprintf(&text, "%s\t%s\t%d parts\t%s\t%s\t%s\n", j.ID, state, len(j.Parts), j.UpdatedAt.Format(time.RFC3339), j.Source.Path, j.Service)
+	}
+	if len(uploads) > 0 || c.json {
+		c.print(uploads, text.String())
+	}
+	if *dryRun {
+		return nil
+	}
+	return shared.SweepUploads(ctx, service, stale)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/fileservice"
+	"github.com/osga1291/upload/shared"
+)
+
+// destination is where upload and loadtest create files: a DataOcean path
+// and regions, or a FileService folder.
+type destination struct {
+	path    string
+	regions string
+	parent  string
+}
+
+// register adds the flags of d to flags; pathUsage documents -path.
+func (d *destination) register(flags *flag.FlagSet, pathUsage string) {
+	flags.StringVar(&d.path, "path", "", pathUsage)
+	flags.StringVar(&d.regions, "regions", "", "comma separated DataOcean regions")
+	flags.StringVar(&d.parent, "parent", "", "FileService folder id (default the space)")
+}
+
+// payload returns the create payload of a file called name.
+func (d *destination) payload(c *cli, name string, multipart bool) shared.Payload {
+	if c.backend == dataocean.ServiceName {
+		path := d.path
+		if path == "" {
+			path = "/" + shared.GenerateRandomString(5) + "/" + name
+		}
+		req := dataocean.NewFileRequest(path)
+		if d.regions != "" {
+			req.Regions(strings.Split(d.regions, ",")...)
+		}
+		req.SetMultipart(multipart)
+		return req
+	}
+	parent := d.parent
+	if parent == "" {
+		parent = c.spaceId
+	}
+	req := fileservice.NewUploadRequest(name, parent)
+	req.SetMultipart(multipart)
+	return req
+}
+
+// isMultipart reports whether a file of size bytes is uploaded in parts: when
+// it is bigger than the smallest part the backend takes, or than -chunk-size.
+func (c *cli) isMultipart(service shared.Service, size int64, force bool) bool {
+	return force || size >= service.GetPartLimits().MinPartSize || (c.chunkSize > 0 && size >= int64(c.chunkSize))
+}
+
+type uploadResult struct {
+	FileID  string  `json:"fileId"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+	Resumed bool    `json:"resumed,omitempty"`
+}
+
+func uploadCommand(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags()
+	var dst destination
+	dst.register(flags, "DataOcean path of the file (default /<random>/<file name>)")
+	name := flags.String("name", "", "FileService file name (default the local file name)")
+	multipart := flags.Bool("multipart", false, "upload in parts even when the file is small")
+	urlDuration := flags.String("url-duration", "", "how long the upload URLs stay valid, such as 7d")
+	verify := flags.Bool("verify", false, "compare the SHA-256 of the file with the one the backend stores")
+	checksum := flags.String("checksum", "", "checksum sent with every part: md5, sha256 or crc32c")
+	journal := flags.Bool("journal", false, "keep a journal of the parts sent, and resume from it if one is found")
+	stateDir := flags.String("state-dir", "", "directory of the journal (default next to the file)")
+	progress := flags.Bool("progress", false, "report progress on stderr")
+	err := parse(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	service, err := c.service()
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if *name == "" {
+		*name = filepath.Base(file.Name())
+	}
+	payload := dst.payload(c, *name, c.isMultipart(service, info.Size(), *multipart))
+	var queryParams map[string]string
+	if *urlDuration != "" {
+		queryParams = map[string]string{"urlDuration": *urlDuration}
+	}
+	opts := c.options()
+	opts.AutoChunkSize = c.chunkSize == 0
+	opts.VerifyChecksum = *verify
+	opts.Checksum = shared.ChecksumAlgorithm(*checksum)
+	if *progress {
+		opts.Progress = c.progress()
+	}
+
+	start := time.Now()
+	result := uploadResult{Bytes: info.Size()}
+	if *journal {
+		opts.Journal, err = shared.JournalPath(file, *stateDir)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(opts.Journal); err == nil {
+			result.Resumed = true
+			result.FileID, err = shared.ResumeUploadContext(ctx, service, opts.Journal, file, opts)
+		} else {
+			result.FileID, err = shared.UploadContext(ctx, service, payload, queryParams, file, opts)
+		}
+	} else {
+		result.FileID, err = shared.UploadContext(ctx, service, payload, queryParams, file, opts)
+	}
+	if err != nil {
+		return err
+	}
+	result.Seconds = time.Since(start).Seconds()
+	c.print(result, result.FileID)
+	return nil
+}
+
+type downloadResult struct {
+	FileID  string  `json:"fileId"`
+	Path    string  `json:"path"`
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+}
+
+func downloadCommand(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags()
+	verify := flags.Bool("verify", false, "compare the SHA-256 of the download with the one the backend stores")
+	journal := flags.Bool("journal", false, "keep a journal next to dst, and resume from it if one is found")
+	progress := flags.Bool("progress", false, "report progress on stderr")
+	err := parse(flags, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	service, err := c.service()
+	if err != nil {
+		return err
+	}
+	fileId, path := flags.Arg(0), flags.Arg(1)
+	// dst is not truncated so that a journaled download can resume; Download
+	// truncates it to the size of the file when done.
+	dst, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	opts := c.options()
+	opts.VerifyChecksum = *verify
+	if *journal {
+		opts.Journal = path + ".download.json"
+	}
+	if *progress {
+		opts.Progress = c.progress()
+	}
+	start := time.Now()
+	err = shared.DownloadContext(ctx, service, fileId, dst, opts)
+	if err != nil {
+		return err
+	}
+	info, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+	result := downloadResult{FileID: fileId, Path: path, Bytes: info.Size(), Seconds: time.Since(start).Seconds()}
+	c.print(result, path)
+	return nil
+}
+
+func statCommand(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags()
+	err := parse(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	service, err := c.service()
+	if err != nil {
+		return err
+	}
+
+	var text strings.Builder
+	w := tabwriter.NewWriter(&text, 0, 4, 2, ' ', 0)
+	switch s := service.(type) {
+	case *dataocean.DataOcean:
+		file, err := s.StatContext(ctx, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "id\t%s\npath\t%s\nstatus\t%s\nsize\t%d\nsha256\t%s\nregions\t%s\n", file.ID, file.Path, file.Status, file.Size, file.SHA256, strings.Join(file.Regions, ","))
+		w.Flush()
+		c.print(file, text.String())
+	case *fileservice.FileService:
+		file, err := s.StatContext(ctx, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "id\t%s\nname\t%s\nparentId\t%s\nsize\t%d\nsha256\t%s\n", file.ID, file.Name, file.ParentID, file.Size, file.SHA256)
+		w.Flush()
+		c.print(file, text.String())
+	}
+	return nil
+}
+
+func mkdirCommand(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags()
+	parent := flags.String("parent", "", "FileService folder to create the folder in (default the space)")
+	err := parse(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	service, err := c.service()
+	if err != nil {
+		return err
+	}
+
+	var id string
+	switch s := service.(type) {
+	case *dataocean.DataOcean:
+		id, err = s.CreateFolderContext(ctx, flags.Arg(0))
+	case *fileservice.FileService:
+		if *parent == "" {
+			*parent = c.spaceId
+		}
+		id, err = s.CreateNamedFolderContext(ctx, *parent, flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	c.print(map[string]string{"folderId": id}, id)
+	return nil
+}
+
+func lsCommand(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags()
+	err := parse(flags, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	service, err := c.service()
+	if err != nil {
+		return err
+	}
+
+	var text strings.Builder
+	w := tabwriter.NewWriter(&text, 0, 4, 2, ' ', 0)
+	switch s := service.(type) {
+	case *dataocean.DataOcean:
+		prefix := flags.Arg(0)
+		if prefix == "" {
+			prefix = "/"
+		}
+		files, err := s.ListFilesContext(ctx, prefix)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "ID\tSTATUS\tSIZE\tPATH\n")
+		for _, f := range files {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", f.ID, f.Status, f.Size, f.Path)
+		}
+		w.Flush()
+		c.print(files, text.String())
+	case *fileservice.FileService:
+		folderId := flags.Arg(0)
+		if folderId == "" {
+			folderId = c.spaceId
+		}
+		files, err := s.ListFilesContext(ctx, folderId)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "ID\tSIZE\tNAME\n")
+		for _, f := range files {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", f.ID, f.Size, f.Name)
+		}
+		w.Flush()
+		c.print(files, text.String())
+	}
+	return nil
+}
+
+func rmCommand(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags()
+	err := parse(flags, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	service, err := c.service()
+	if err != nil {
+		return err
+	}
+
+	deleted := []string{}
+	var errs []error
+	for _, id := range flags.Args() {
+		switch s := service.(type) {
+		case *dataocean.DataOcean:
+			err = s.DeleteContext(ctx, id)
+		case *fileservice.FileService:
+			err = s.DeleteContext(ctx, id)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("file %s: %w", id, err))
+			continue
+		}
+		deleted = append(deleted, id)
+	}
+	if len(deleted) > 0 {
+		c.print(map[string][]string{"deleted": deleted}, strings.Join(deleted, "\n"))
+	}
+	return errors.Join(errs...)
+}
+
+func waitCommand(ctx context.Context, c *cli, args []string) error {
+	flags := c.flags()
+	timeout := flags.Duration("poll-timeout", shared.DefaultPoller.Timeout, "give up when the file is still not available after this long")
+	err := parse(flags, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	service, err := c.service()
+	if err != nil {
+		return err
+	}
+
+	poller := shared.DefaultPoller
+	poller.Timeout = *timeout
+	switch s := service.(type) {
+	case *dataocean.DataOcean:
+		s.SetPoller(poller)
+	case *fileservice.FileService:
+		s.SetPoller(poller)
+	}
+	id := flags.Arg(0)
+	err = service.WaitForAvailableContext(ctx, id)
+	if err != nil {
+		return err
+	}
+	c.print(map[string]interface{}{"id": id, "available": true}, id+" is available")
+	return nil
+}
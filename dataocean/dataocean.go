@@ -1,20 +1,24 @@
 package dataocean
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
-	"strings"
 
 	"github.com/osga1291/upload/shared"
 )
 
+// ServiceName is the key of the DataOcean base URL in a shared.Environment.
+const ServiceName = "dataocean"
+
 type DataOcean struct {
-	client http.Client
-	path   string
-	urls   map[string]string
+	client  http.Client
+	creds   shared.CredentialProvider
+	retry   shared.RetryPolicy
+	poller  shared.Poller
+	baseURL string
+	routes  shared.Routes
 }
 
 type AssemblyPage struct {
@@ -30,14 +34,24 @@ type AssembleTag struct {
 	PartNumber int    `json:"part_number"`
 }
 
-func NewDataOcean() *DataOcean {
+// NewDataOcean returns a client for the DataOcean of env. GetUrl fails when
+// env has no base URL for ServiceName.
+func NewDataOcean(env shared.Environment, creds shared.CredentialProvider) *DataOcean {
+	baseURL, _ := env.BaseURL(ServiceName)
 	return &DataOcean{
-		client: http.Client{},
-		urls: map[string]string{
-			"createFolder": "*/folders",
-			"createFile":   "*/files",
-			"getFile":      "*/files/fileId",
-			"assembleFile": "*/files/resourceId/assemble",
+		client:  http.Client{},
+		creds:   creds,
+		retry:   shared.DefaultRetryPolicy,
+		poller:  shared.DefaultPoller.WithStates(fileStates),
+		baseURL: baseURL,
+		routes: shared.Routes{
+			"createFolder":         {Path: "/folders"},
+			"listFiles":            {Path: "/files"},
+			shared.RouteCreateFile: {Path: "/files"},
+			shared.RouteGetFile:    {Path: "/files/{fileId}"},
+			"updateFile":           {Path: "/files/{fileId}"},
+			"assembleFile":         {Path: "/files/{resourceId}/assemble"},
+			"deleteFile":           {Path: "/files/{fileId}"},
 		},
 	}
 }
@@ -46,81 +60,78 @@ func (do *DataOcean) GetClient() *http.Client {
 	return &do.client
 }
 
-func (do *DataOcean) GetUrl(action string, replaceMap map[string]string) (string, error) {
-	url, ok := do.urls[action]
-	if !ok {
-		return "", fmt.Errorf("action %s is not found", action)
+func (do *DataOcean) GetCredentials() shared.CredentialProvider {
+	return do.creds
+}
+
+func (do *DataOcean) GetRetryPolicy() shared.RetryPolicy {
+	return do.retry
+}
+
+// GetPartLimits returns the multipart limits of DataOcean.
+func (do *DataOcean) GetPartLimits() shared.PartLimits {
+	return shared.PartLimits{
+		MaxParts:    10000,
+		MinPartSize: 5 * 1024 * 1024,        // 5 MB
+		MaxPartSize: 5 * 1024 * 1024 * 1024, // 5 GB
 	}
+}
+
+func (do *DataOcean) SetRetryPolicy(policy shared.RetryPolicy) {
+	do.retry = policy
+}
 
-	for k, v := range replaceMap {
-		url = strings.Replace(url, k, v, -1)
+// SetPoller sets how WaitForAvailable polls. The file statuses of DataOcean
+// are kept when poller has no States.
+func (do *DataOcean) SetPoller(poller shared.Poller) {
+	if poller.States == nil {
+		poller.States = fileStates
 	}
-	return url, nil
+	do.poller = poller
+}
 
+// Identity returns the backend and base URL uploads are started on.
+func (do *DataOcean) Identity() shared.ServiceIdentity {
+	return shared.ServiceIdentity{Name: ServiceName, BaseURL: do.baseURL}
 }
 
-func (do *DataOcean) ExtractCreateFileResp(resp *http.Response) (string, string, string, error) {
-	var result map[string]interface{}
-	defer resp.Body.Close()
-	if resp.Body != nil {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Panic(err)
-		}
-		err = json.Unmarshal(bodyBytes, &result)
-		if err != nil {
-			log.Panic(err)
-		}
-		if file, ok := result["file"].(map[string]interface{}); ok {
-			upload, ok := file["upload"].(map[string]interface{})
-			if ok {
-				return file["id"].(string), upload["url"].(string), file["id"].(string), nil
-			}
-		}
-	}
-	return "", "", "", fmt.Errorf("Error")
+func (do *DataOcean) GetUrl(action string, replaceMap map[string]string) (string, error) {
+	if do.baseURL == "" {
+		return "", fmt.Errorf("no base URL configured for %s", ServiceName)
+	}
+	return do.routes.URL(do.baseURL, action, replaceMap)
+
 }
 
-func (do *DataOcean) WaitForAvailable(resourceId string) error {
-	url, err := do.GetUrl("getFile", map[string]string{"fileId": resourceId})
+func (do *DataOcean) ExtractCreateFileResp(resp *http.Response) (string, string, string, error) {
+	defer resp.Body.Close()
+	var result FileResponse
+	err := json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
-		return err
+		return "", "", "", fmt.Errorf("%w: %v", shared.ErrInvalidResponse, err)
 	}
-	for {
-		resp, err := shared.Request(
-			do.GetClient(), "GET", url, nil, nil)
-
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-		if resp.Body != nil {
-			bodyBytes, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Panic(err)
-			}
-			var result map[string]interface{}
-			err = json.Unmarshal(bodyBytes, &result)
-			if err != nil {
-				return err
-			}
-			if resp.StatusCode == http.StatusOK {
-				if file, ok := result["file"].(map[string]interface{}); ok {
-					if status, ok := file["status"]; ok && status == "AVAILABLE" {
-						fmt.Println("File is available")
-						return nil
-					} else if status == "ARCHIVE_PROCESSING_FAILED" {
-						return fmt.Errorf("File processing failed")
-					}
-				}
-			} else {
-				return fmt.Errorf("Bad request on waiting for file: %s", result)
-			}
-		}
+	if result.File.ID == "" || result.File.Upload == nil || result.File.Upload.URL == "" {
+		return "", "", "", fmt.Errorf("%w: create file response has no file id or upload url", shared.ErrInvalidResponse)
 	}
+	return result.File.ID, result.File.Upload.URL, result.File.ID, nil
+}
+
+func (do *DataOcean) WaitForAvailable(resourceId string) error {
+	return do.WaitForAvailableContext(context.Background(), resourceId)
+}
+
+func (do *DataOcean) WaitForAvailableContext(ctx context.Context, resourceId string) error {
+	return do.poller.Wait(ctx, "file "+resourceId, func(ctx context.Context) (string, error) {
+		file, err := do.file(ctx, resourceId)
+		return string(file.Status), err
+	})
 }
 
 func (do *DataOcean) Assemble(id string, parts []shared.AssembleTag) error {
+	return do.AssembleContext(context.Background(), id, parts)
+}
+
+func (do *DataOcean) AssembleContext(ctx context.Context, id string, parts []shared.AssembleTag) error {
 
 	p := AssemblyParts{
 		Etags: parts,
@@ -134,21 +145,91 @@ func (do *DataOcean) Assemble(id string, parts []shared.AssembleTag) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(s))
 	url, err := do.GetUrl("assembleFile", map[string]string{"resourceId": id})
 	if err != nil {
 		return err
 	}
 
-	resp, err := shared.Request(do.GetClient(), "POST", url, &s, nil)
+	resp, err := shared.RequestContext(ctx, do.GetClient(), do.GetCredentials(), "POST", url, &s, nil, shared.RequestOptions{Retry: do.GetRetryPolicy()})
 	if err != nil {
 		return err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Assemble request failed with status: %d\n", resp.StatusCode)
+		return shared.NewAPIError(resp)
+	}
+	resp.Body.Close()
+	return nil
+
+}
+
+// Abort deletes a file whose upload will not be completed.
+func (do *DataOcean) Abort(id string) error {
+	return do.AbortContext(context.Background(), id)
+}
+
+func (do *DataOcean) AbortContext(ctx context.Context, id string) error {
+	return do.deleteFile(ctx, id, false)
+}
+
+// Delete deletes a file. Unlike Abort it fails when DataOcean does not
+// confirm the deletion.
+func (do *DataOcean) Delete(fileId string) error {
+	return do.DeleteContext(context.Background(), fileId)
+}
+
+func (do *DataOcean) DeleteContext(ctx context.Context, fileId string) error {
+	return do.deleteFile(ctx, fileId, true)
+}
+
+// deleteFile deletes the file fileId. With confirm it fails unless DataOcean
+// answers 200 or 204.
+func (do *DataOcean) deleteFile(ctx context.Context, fileId string, confirm bool) error {
+	url, err := do.GetUrl("deleteFile", map[string]string{"fileId": fileId})
+	if err != nil {
+		return err
+	}
+	resp, err := shared.RequestContext(ctx, do.GetClient(), do.GetCredentials(), "DELETE", url, nil, nil, shared.RequestOptions{Retry: do.GetRetryPolicy()})
+	if err != nil {
+		return err
+	}
+	if confirm && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return shared.NewAPIError(resp)
 	}
+	resp.Body.Close()
 	return nil
+}
 
+// CreateFolder creates the folder at path and returns its id.
+func (do *DataOcean) CreateFolder(path string) (string, error) {
+	return do.CreateFolderContext(context.Background(), path)
+}
+
+func (do *DataOcean) CreateFolderContext(ctx context.Context, path string) (string, error) {
+	jsonBytes, err := json.Marshal(FolderResponse{Folder: Folder{Path: path}})
+	if err != nil {
+		return "", err
+	}
+	url, err := do.GetUrl("createFolder", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := shared.RequestContext(ctx, do.GetClient(), do.GetCredentials(), "POST", url, &jsonBytes, nil, shared.RequestOptions{Retry: do.GetRetryPolicy()})
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return "", shared.NewAPIError(resp)
+	}
+	defer resp.Body.Close()
+	var result FolderResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", shared.ErrInvalidResponse, err)
+	}
+	if result.Folder.ID == "" {
+		return "", fmt.Errorf("%w: folder response has no id", shared.ErrInvalidResponse)
+	}
+	return result.Folder.ID, nil
 }
 
 func (do *DataOcean) CreateTag(etag string, partNumber int) shared.AssembleTag {
@@ -160,35 +241,105 @@ func (do *DataOcean) CreateTag(etag string, partNumber int) shared.AssembleTag {
 	}
 }
 
-func (do *DataOcean) rename(fileId string) string {
+func (do *DataOcean) rename(fileId string) (string, error) {
 	randPath := fmt.Sprintf("/%s/updated/name", shared.GenerateRandomString(10))
-	jsonData := map[string]interface{}{
-		"file": map[string]string{
-			"path": randPath,
-		},
+	jsonBytes, err := json.Marshal(FileResponse{File: File{Path: randPath}})
+	if err != nil {
+		return "", err
+	}
+	url, err := do.GetUrl("updateFile", map[string]string{"fileId": fileId})
+	if err != nil {
+		return "", err
 	}
-	jsonBytes, err := json.Marshal(jsonData)
+	resp, err := shared.Request(do.GetClient(), do.GetCredentials(), "PATCH", url, &jsonBytes, nil, shared.RequestOptions{Retry: do.GetRetryPolicy()})
 	if err != nil {
-		log.Panic(err)
+		return "", err
 	}
-	resp, err := shared.Request(do.GetClient(), "PATCH", fmt.Sprintf("*/files/%s", fileId), &jsonBytes, nil)
-	if resp.StatusCode == http.StatusAccepted {
-		fmt.Println("JSON request successful")
-	} else {
-		fmt.Printf("JSON request failed with status: %d\n", resp.StatusCode)
+	if resp.StatusCode != http.StatusAccepted {
+		return "", shared.NewAPIError(resp)
 	}
+	resp.Body.Close()
+	return randPath, nil
+}
+
+// WrapPayload adapts a map payload, whose file fields are under "file".
+func (do *DataOcean) WrapPayload(fields map[string]interface{}) shared.Payload {
+	return &shared.MapPayload{Fields: fields, Object: "file"}
+}
 
-	return randPath
+// MD5ETags reports that DataOcean part ETags are the MD5 of the part.
+func (do *DataOcean) MD5ETags() bool {
+	return true
 }
 
-func (do *DataOcean) CheckIfMultipart(payload map[string]interface{}) (bool, error) {
+// FileChecksum returns the SHA-256 DataOcean stored for the file, or "" when
+// it has none.
+func (do *DataOcean) FileChecksum(ctx context.Context, fileId string) (string, error) {
+	file, err := do.file(ctx, fileId)
+	if err != nil {
+		return "", err
+	}
+	return file.SHA256, nil
+}
 
-	if file, ok := payload["file"].(map[string]interface{}); ok {
-		if multipart, ok := file["multipart"]; !ok || multipart.(bool) == false {
-			return false, nil
-		} else {
-			return true, nil
-		}
+// DownloadInfo returns the download URL, size and SHA-256 of an available
+// file.
+func (do *DataOcean) DownloadInfo(ctx context.Context, fileId string) (shared.DownloadInfo, error) {
+	file, err := do.file(ctx, fileId)
+	if err != nil {
+		return shared.DownloadInfo{}, err
+	}
+	if file.Download == nil {
+		return shared.DownloadInfo{}, fmt.Errorf("%w: file %s has no download URL", shared.ErrInvalidResponse, fileId)
+	}
+	return shared.DownloadInfo{URL: file.Download.URL, Size: file.Size, SHA256: file.SHA256}, nil
+}
+
+// Stat returns the metadata of a file.
+func (do *DataOcean) Stat(fileId string) (File, error) {
+	return do.file(context.Background(), fileId)
+}
+
+func (do *DataOcean) StatContext(ctx context.Context, fileId string) (File, error) {
+	return do.file(ctx, fileId)
+}
+
+// ListFiles returns the files whose path starts with prefix.
+func (do *DataOcean) ListFiles(prefix string) ([]File, error) {
+	return do.ListFilesContext(context.Background(), prefix)
+}
+
+func (do *DataOcean) ListFilesContext(ctx context.Context, prefix string) ([]File, error) {
+	url, err := do.GetUrl("listFiles", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := shared.RequestContext(ctx, do.GetClient(), do.GetCredentials(), "GET", url, nil, map[string]string{"path": prefix}, shared.RequestOptions{Retry: do.GetRetryPolicy()})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, shared.NewAPIError(resp)
+	}
+	defer resp.Body.Close()
+	var result FilesResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", shared.ErrInvalidResponse, err)
+	}
+	return result.Files, nil
+}
+
+func (do *DataOcean) file(ctx context.Context, fileId string) (File, error) {
+	resp, err := shared.GetFileContext(ctx, do, fileId, nil)
+	if err != nil {
+		return File{}, err
+	}
+	defer resp.Body.Close()
+	var result FileResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return File{}, fmt.Errorf("%w: %v", shared.ErrInvalidResponse, err)
 	}
-	return false, fmt.Errorf("Invalid payload")
+	return result.File, nil
 }
@@ -0,0 +1,255 @@
+package dataocean_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/dataocean/dataoceantest"
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+func TestSinglepartUpload(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	file, content := sharedtest.TempFile(t, 300*1024)
+
+	fileId, err := shared.Upload(server.Client(), dataocean.NewFileRequest("/a/single.bin"), nil, file, shared.UploadOptions{VerifyChecksum: true, Checksum: shared.ChecksumMD5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, ok := server.Content(fileId)
+	if !ok || !bytes.Equal(stored, content) {
+		t.Fatalf("stored content differs from the source")
+	}
+	meta, _ := server.File(fileId)
+	if meta.Status != dataocean.FileStatusAvailable || meta.Path != "/a/single.bin" {
+		t.Fatalf("file is %+v", meta)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	file, content := sharedtest.TempFile(t, 11*1024*1024)
+
+	payload := dataocean.NewFileRequest("/a/multi.bin").Multipart()
+	fileId, err := shared.Upload(server.Client(), payload, nil, file, shared.UploadOptions{ChunkSize: 5 * 1024 * 1024, MaxRoutines: 3, VerifyChecksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parts := server.Blobs.Parts(fileId); len(parts) != 3 {
+		t.Fatalf("uploaded parts %v, want 3", parts)
+	}
+	stored, ok := server.Content(fileId)
+	if !ok || !bytes.Equal(stored, content) {
+		t.Fatalf("stored content differs from the source")
+	}
+}
+
+func TestUploadProcessingFailed(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	server.FailProcessing = func(file dataocean.File) bool { return file.Path == "/a/broken.zip" }
+	file, _ := sharedtest.TempFile(t, 1024)
+
+	_, err := shared.Upload(server.Client(), dataocean.NewFileRequest("/a/broken.zip"), nil, file)
+	if !errors.Is(err, shared.ErrProcessingFailed) {
+		t.Fatalf("got %v, want ErrProcessingFailed", err)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	file, content := sharedtest.TempFile(t, 1024*1024+17)
+	fileId, err := shared.Upload(do, dataocean.NewFileRequest("/a/download.bin"), nil, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := os.Create(filepath.Join(t.TempDir(), "download"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	err = shared.Download(do, fileId, dst, shared.UploadOptions{ChunkSize: 100 * 1024, MaxRoutines: 4, VerifyChecksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("downloaded content differs from the upload")
+	}
+}
+
+func TestTokenRefreshedAfterRevocation(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	file, _ := sharedtest.TempFile(t, 1024)
+	fileId, err := shared.Upload(do, dataocean.NewFileRequest("/a/token.bin"), nil, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.OAuth.RevokeAll()
+	_, err = do.FileChecksum(context.Background(), fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued := server.OAuth.Issued(); issued != 2 {
+		t.Fatalf("issued %d tokens, want 2", issued)
+	}
+}
+
+func TestFolderListStatDelete(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	file, _ := sharedtest.TempFile(t, 1024)
+
+	folderId, err := do.CreateFolder("/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if folder, ok := server.Folder(folderId); !ok || folder.Path != "/b" {
+		t.Fatalf("folder is %+v", folder)
+	}
+	var ids []string
+	for _, path := range []string{"/b/2.bin", "/b/1.bin", "/c/3.bin"} {
+		file.Seek(0, 0)
+		id, err := shared.Upload(do, dataocean.NewFileRequest(path), nil, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	files, err := do.ListFiles("/b/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Path != "/b/1.bin" || files[1].Path != "/b/2.bin" {
+		t.Fatalf("listed %+v", files)
+	}
+
+	meta, err := do.Stat(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Path != "/b/2.bin" || meta.Size != 1024 || meta.Status != dataocean.FileStatusAvailable {
+		t.Fatalf("stat is %+v", meta)
+	}
+
+	err = do.Delete(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = do.Stat(ids[0])
+	if !errors.Is(err, shared.ErrNotFound) {
+		t.Fatalf("deleted file: got %v, want ErrNotFound", err)
+	}
+	err = do.Delete(ids[0])
+	if !errors.Is(err, shared.ErrNotFound) {
+		t.Fatalf("deleting twice: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+
+	_, err := shared.GetFile(server.Client(), "missing", nil)
+	if !errors.Is(err, shared.ErrNotFound) {
+		t.Errorf("missing file: got %v, want ErrNotFound", err)
+	}
+
+	do := dataocean.NewDataOcean(server.Environment(), server.Environment().Credentials(dataoceantest.ClientID, "wrong"))
+	_, err = shared.GetFile(do, "missing", nil)
+	if !errors.Is(err, shared.ErrUnauthorized) {
+		t.Errorf("wrong secret: got %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestFileRequest(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	createUrl, err := do.GetUrl(shared.RouteCreateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		payload func() shared.Payload
+		want    string
+	}{
+		{"path", func() shared.Payload { return dataocean.NewFileRequest("/a/b.bin") },
+			`{"file":{"path":"/a/b.bin"}}`},
+		{"regions, multipart and fileset", func() shared.Payload {
+			return dataocean.NewFileRequest("/a/b.bin").Regions("us1", "eu1").Multipart().Fileset()
+		}, `{"file":{"path":"/a/b.bin","regions":["us1","eu1"],"multipart":true,"fileset":true}}`},
+		{"multipart cleared", func() shared.Payload {
+			p := dataocean.NewFileRequest("/a/b.bin").Multipart()
+			p.SetMultipart(false)
+			return p
+		}, `{"file":{"path":"/a/b.bin"}}`},
+		{"checksum", func() shared.Payload {
+			p := dataocean.NewFileRequest("/a/b.bin")
+			p.SetChecksum("abc")
+			return p
+		}, `{"file":{"path":"/a/b.bin","sha256":"abc"}}`},
+		{"map", func() shared.Payload {
+			p := do.WrapPayload(map[string]interface{}{"file": map[string]interface{}{"path": "/a/b.bin", "regions": []string{"us1"}}})
+			p.SetMultipart(true)
+			return p
+		}, `{"file":{"multipart":true,"path":"/a/b.bin","regions":["us1"]}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload := test.payload()
+			b, err := json.Marshal(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != test.want {
+				t.Fatalf("got %s, want %s", b, test.want)
+			}
+
+			// The fake records the file as it was requested.
+			resp, err := shared.CreateFile(do, payload, createUrl, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			id, _, _, err := do.ExtractCreateFileResp(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want dataocean.FileRequest
+			err = json.Unmarshal([]byte(test.want), &want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := server.File(id)
+			got.ID, got.Status = "", ""
+			if !reflect.DeepEqual(got, want.File) {
+				t.Errorf("created %+v, want %+v", got, want.File)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// Package dataoceantest runs an in-memory DataOcean, with its presigned
+// upload URLs and an OAuth token endpoint, so clients can be tested offline.
+package dataoceantest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+// The client credentials accepted by the token endpoint.
+const (
+	ClientID     = "dataoceantest-client"
+	ClientSecret = "dataoceantest-secret"
+)
+
+// Server is a fake DataOcean. It serves:
+//
+//	POST   /folders              create a folder
+//	POST   /files                create a file and its upload URL
+//	GET    /files?path={prefix}  the files whose path starts with prefix
+//	GET    /files/{id}           the file, advancing its status
+//	PATCH  /files/{id}           change the path of the file
+//	DELETE /files/{id}           delete the file
+//	POST   /files/{id}/assemble  join the uploaded parts
+//
+// together with the presigned URLs of sharedtest.Blobs and the token endpoint
+// of sharedtest.OAuth at sharedtest.TokenPath.
+type Server struct {
+	*httptest.Server
+	OAuth *sharedtest.OAuth
+	Blobs *sharedtest.Blobs
+	// PendingPolls is how many times a file whose content is complete is
+	// still reported UNAVAILABLE before it is processed.
+	PendingPolls int
+	// FailProcessing makes the files it returns true for end up
+	// ARCHIVE_PROCESSING_FAILED. Files whose content does not match the
+	// sha256 they were created with always do.
+	FailProcessing func(file dataocean.File) bool
+
+	mutex   sync.Mutex
+	files   map[string]*file
+	folders map[string]dataocean.Folder
+}
+
+type file struct {
+	meta  dataocean.File
+	polls int
+}
+
+// NewServer starts a Server. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		OAuth:        sharedtest.NewOAuth(ClientID, ClientSecret),
+		Blobs:        sharedtest.NewBlobs(),
+		PendingPolls: 1,
+		files:        map[string]*file{},
+		folders:      map[string]dataocean.Folder{},
+	}
+	mux := http.NewServeMux()
+	mux.Handle(sharedtest.TokenPath, s.OAuth)
+	mux.Handle(sharedtest.BlobsPath, s.Blobs)
+	mux.Handle("/folders", s.OAuth.Authorize(http.HandlerFunc(s.createFolder)))
+	mux.Handle("/files", s.OAuth.Authorize(http.HandlerFunc(s.serveFiles)))
+	mux.Handle("/files/", s.OAuth.Authorize(http.HandlerFunc(s.serveFile)))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Environment returns the environment pointing at s.
+func (s *Server) Environment() shared.Environment {
+	return shared.Environment{
+		Name:     "dataoceantest",
+		BaseURLs: map[string]string{dataocean.ServiceName: s.URL},
+		TokenURL: s.URL + sharedtest.TokenPath,
+	}
+}
+
+// Credentials returns client credentials accepted by s.
+func (s *Server) Credentials() *shared.ClientCredentials {
+	return s.Environment().Credentials(ClientID, ClientSecret)
+}
+
+// Client returns a DataOcean client for s that polls and retries with short
+// delays.
+func (s *Server) Client() *dataocean.DataOcean {
+	do := dataocean.NewDataOcean(s.Environment(), s.Credentials())
+	do.SetPoller(shared.Poller{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     10 * time.Millisecond,
+		Multiplier:      2,
+		Timeout:         10 * time.Second,
+	})
+	policy := shared.DefaultRetryPolicy
+	policy.BaseDelay = time.Millisecond
+	policy.MaxDelay = 10 * time.Millisecond
+	do.SetRetryPolicy(policy)
+	return do
+}
+
+// File returns the stored metadata of the file id.
+func (s *Server) File(id string) (dataocean.File, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.files[id]
+	if !ok {
+		return dataocean.File{}, false
+	}
+	return f.meta, true
+}
+
+// Content returns the content of the file id once it is complete.
+func (s *Server) Content(id string) ([]byte, bool) {
+	return s.Blobs.Content(id)
+}
+
+// Folder returns the folder id.
+func (s *Server) Folder(id string) (dataocean.Folder, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f, ok := s.folders[id]
+	return f, ok
+}
+
+func (s *Server) createFolder(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req dataocean.FolderResponse
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Folder.Path == "" {
+		sharedtest.WriteJSON(w, http.StatusBadRequest, map[string]string{"message": "folder.path is required"})
+		return
+	}
+	folder := req.Folder
+	folder.ID = sharedtest.RandomID(8)
+	s.mutex.Lock()
+	s.folders[folder.ID] = folder
+	s.mutex.Unlock()
+	sharedtest.WriteJSON(w, http.StatusCreated, dataocean.FolderResponse{Folder: folder})
+}
+
+func (s *Server) serveFiles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		s.createFile(w, r)
+	case http.MethodGet:
+		s.listFiles(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("path")
+	s.mutex.Lock()
+	files := []dataocean.File{}
+	for _, f := range s.files {
+		if strings.HasPrefix(f.meta.Path, prefix) {
+			files = append(files, f.meta)
+		}
+	}
+	s.mutex.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	sharedtest.WriteJSON(w, http.StatusOK, dataocean.FilesResponse{Files: files})
+}
+
+func (s *Server) createFile(w http.ResponseWriter, r *http.Request) {
+	var req dataocean.FileRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.File.Path == "" {
+		sharedtest.WriteJSON(w, http.StatusBadRequest, map[string]string{"message": "file.path is required"})
+		return
+	}
+
+	meta := req.File
+	meta.ID = sharedtest.RandomID(8)
+	meta.Status = dataocean.FileStatusUnavailable
+	meta.Upload = nil
+	s.mutex.Lock()
+	s.files[meta.ID] = &file{meta: meta}
+	s.mutex.Unlock()
+
+	meta.Upload = &dataocean.Upload{URL: s.Blobs.Create(s.URL, meta.ID, meta.Multipart)}
+	sharedtest.WriteJSON(w, http.StatusCreated, dataocean.FileResponse{File: meta})
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/files/"), "/")
+	s.mutex.Lock()
+	_, ok := s.files[id]
+	s.mutex.Unlock()
+	if !ok {
+		sharedtest.WriteJSON(w, http.StatusNotFound, map[string]string{"message": "file " + id + " not found"})
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		sharedtest.WriteJSON(w, http.StatusOK, dataocean.FileResponse{File: s.poll(id)})
+	case action == "" && r.Method == http.MethodPatch:
+		var req dataocean.FileRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			sharedtest.WriteJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+			return
+		}
+		s.mutex.Lock()
+		f := s.files[id]
+		if req.File.Path != "" {
+			f.meta.Path = req.File.Path
+		}
+		meta := f.meta
+		s.mutex.Unlock()
+		sharedtest.WriteJSON(w, http.StatusAccepted, dataocean.FileResponse{File: meta})
+	case action == "" && r.Method == http.MethodDelete:
+		s.mutex.Lock()
+		delete(s.files, id)
+		s.mutex.Unlock()
+		s.Blobs.Delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "assemble" && r.Method == http.MethodPost:
+		s.assemble(w, r, id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) assemble(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		Upload struct {
+			Parts []struct {
+				Etag       string `json:"etag"`
+				PartNumber int    `json:"part_number"`
+			} `json:"parts"`
+		} `json:"upload"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		sharedtest.WriteJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	parts := make([]sharedtest.Part, len(req.Upload.Parts))
+	for i, p := range req.Upload.Parts {
+		parts[i] = sharedtest.Part{PartNumber: p.PartNumber, Etag: p.Etag}
+	}
+	err = s.Blobs.Assemble(id, parts)
+	if err != nil {
+		sharedtest.WriteJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	sharedtest.WriteJSON(w, http.StatusOK, map[string]string{"id": id})
+}
+
+// poll returns the file id as a GET reports it. Once its content is complete
+// the file stays UNAVAILABLE for PendingPolls polls and is then processed.
+func (s *Server) poll(id string) dataocean.File {
+	content, complete := s.Blobs.Content(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f := s.files[id]
+	if !complete || f.meta.Status != dataocean.FileStatusUnavailable {
+		return f.meta
+	}
+	f.polls++
+	if f.polls <= s.PendingPolls {
+		return f.meta
+	}
+
+	sum := sharedtest.SHA256(content)
+	if (f.meta.SHA256 != "" && f.meta.SHA256 != sum) || (s.FailProcessing != nil && s.FailProcessing(f.meta)) {
+		f.meta.Status = dataocean.FileStatusArchiveProcessingFailed
+		return f.meta
+	}
+	f.meta.Status = dataocean.FileStatusAvailable
+	f.meta.SHA256 = sum
+	f.meta.Size = int64(len(content))
+	f.meta.Download = &dataocean.Download{URL: s.Blobs.DownloadURL(s.URL, id)}
+	return f.meta
+}
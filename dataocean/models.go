@@ -0,0 +1,101 @@
+package dataocean
+
+import "github.com/osga1291/upload/shared"
+
+// FileStatus is the processing state of a DataOcean file.
+type FileStatus string
+
+const (
+	FileStatusUnavailable             FileStatus = "UNAVAILABLE"
+	FileStatusAvailable               FileStatus = "AVAILABLE"
+	FileStatusArchiveProcessingFailed FileStatus = "ARCHIVE_PROCESSING_FAILED"
+)
+
+// fileStates tells WaitForAvailable which file statuses end the wait.
+var fileStates = map[string]shared.PollState{
+	string(FileStatusUnavailable):             shared.PollPending,
+	string(FileStatusAvailable):               shared.PollSuccess,
+	string(FileStatusArchiveProcessingFailed): shared.PollFailure,
+}
+
+type File struct {
+	ID        string     `json:"id,omitempty"`
+	Path      string     `json:"path,omitempty"`
+	Regions   []string   `json:"regions,omitempty"`
+	Multipart bool       `json:"multipart,omitempty"`
+	Fileset   bool       `json:"fileset,omitempty"`
+	SHA256    string     `json:"sha256,omitempty"`
+	Size      int64      `json:"size,omitempty"`
+	Status    FileStatus `json:"status,omitempty"`
+	Upload    *Upload    `json:"upload,omitempty"`
+	Download  *Download  `json:"download,omitempty"`
+}
+
+// Upload holds the presigned URL the content of a file is sent to. For
+// multipart uploads the URL has a "*" in place of the part number.
+type Upload struct {
+	URL string `json:"url"`
+}
+
+// Download holds the presigned URL the content of an available file is
+// fetched from.
+type Download struct {
+	URL string `json:"url"`
+}
+
+type Folder struct {
+	ID      string   `json:"id,omitempty"`
+	Path    string   `json:"path,omitempty"`
+	Regions []string `json:"regions,omitempty"`
+}
+
+// FileResponse is the body returned for a single file.
+type FileResponse struct {
+	File File `json:"file"`
+}
+
+// FilesResponse is the body returned when files are listed.
+type FilesResponse struct {
+	Files []File `json:"files"`
+}
+
+type FolderResponse struct {
+	Folder Folder `json:"folder"`
+}
+
+// FileRequest creates a DataOcean file. It implements shared.Payload.
+type FileRequest struct {
+	File File `json:"file"`
+}
+
+// NewFileRequest starts the request for a singlepart file at path.
+func NewFileRequest(path string) *FileRequest {
+	return &FileRequest{File: File{Path: path}}
+}
+
+func (r *FileRequest) Regions(regions ...string) *FileRequest {
+	r.File.Regions = append(r.File.Regions, regions...)
+	return r
+}
+
+func (r *FileRequest) Multipart() *FileRequest {
+	r.File.Multipart = true
+	return r
+}
+
+func (r *FileRequest) Fileset() *FileRequest {
+	r.File.Fileset = true
+	return r
+}
+
+func (r *FileRequest) IsMultipart() bool {
+	return r.File.Multipart
+}
+
+func (r *FileRequest) SetMultipart(multipart bool) {
+	r.File.Multipart = multipart
+}
+
+func (r *FileRequest) SetChecksum(sha256 string) {
+	r.File.SHA256 = sha256
+}
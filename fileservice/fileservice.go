@@ -1,37 +1,60 @@
 package fileservice
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
-	"strings"
-	"time"
+	"net/url"
 
 	"github.com/osga1291/upload/shared"
 )
 
+// ServiceName is the key of the FileService base URL in a shared.Environment.
+const ServiceName = "fileservice"
+
 type FileService struct {
 	cacheSpaceId string
 	client       http.Client
-	urls         map[string]string
+	creds        shared.CredentialProvider
+	retry        shared.RetryPolicy
+	poller       shared.Poller
+	baseURL      string
+	clientID     string
+	routes       shared.Routes
 }
 
 type AssemblyPage struct {
 	Etags []shared.AssembleTag `json:"parts"`
 }
 
-func NewFileService() *FileService {
+// complete asks FileService to return the complete resource.
+var complete = url.Values{"complete": {"True"}}
+
+// activeFiles asks FileService for complete files that are not deleted.
+var activeFiles = url.Values{"complete": {"true"}, "status": {"active"}}
+
+// NewFileService returns a client for the FileService of env. GetUrl fails
+// when env has no base URL for ServiceName.
+func NewFileService(env shared.Environment, creds shared.CredentialProvider) *FileService {
+	baseURL, _ := env.BaseURL(ServiceName)
 	return &FileService{
-		client: http.Client{},
-		urls: map[string]string{
-			"createSpace":  "*/spaces/spaceId?complete=True",
-			"createFolder": "*/spaces/spaceId/folders?complete=True",
-			"createFile":   "*/spaces/spaceId/uploads?complete=True",
-			"getFile":      "*/spaces/spaceId/files/fileId?complete=true&status=active",
-			"getUpload":    "*/spaces/spaceId/uploads/uploadId?complete=True",
-			"assembleFile": "*/spaces/spaceId/uploads/resourceId?complete=True",
+		client:   http.Client{},
+		creds:    creds,
+		retry:    shared.DefaultRetryPolicy,
+		poller:   shared.DefaultPoller.WithStates(uploadStates),
+		baseURL:  baseURL,
+		clientID: env.ClientID,
+		routes: shared.Routes{
+			"createSpace":          {Path: "/spaces", Query: complete},
+			"createFolder":         {Path: "/spaces/{spaceId}/folders", Query: complete},
+			shared.RouteCreateFile: {Path: "/spaces/{spaceId}/uploads", Query: complete},
+			shared.RouteGetFile:    {Path: "/spaces/{spaceId}/files/{fileId}", Query: activeFiles},
+			"listFiles":            {Path: "/spaces/{spaceId}/folders/{folderId}/files", Query: activeFiles},
+			"deleteFile":           {Path: "/spaces/{spaceId}/files/{fileId}"},
+			"getUpload":            {Path: "/spaces/{spaceId}/uploads/{uploadId}", Query: complete},
+			"assembleFile":         {Path: "/spaces/{spaceId}/uploads/{resourceId}", Query: complete},
+			"abortUpload":          {Path: "/spaces/{spaceId}/uploads/{uploadId}"},
 		},
 	}
 }
@@ -40,29 +63,60 @@ func (fs *FileService) GetClient() *http.Client {
 	return &fs.client
 }
 
-// GetUrls returns the URLs map
-func (fs *FileService) GetUrl(action string, replaceMap map[string]string) (string, error) {
-	if replaceMap == nil {
-		replaceMap = make(map[string]string)
+func (fs *FileService) GetCredentials() shared.CredentialProvider {
+	return fs.creds
+}
+
+func (fs *FileService) GetRetryPolicy() shared.RetryPolicy {
+	return fs.retry
+}
+
+// GetPartLimits returns the multipart limits of FileService.
+func (fs *FileService) GetPartLimits() shared.PartLimits {
+	return shared.PartLimits{
+		MaxParts:    1000,
+		MinPartSize: 5 * 1024 * 1024,        // 5 MB
+		MaxPartSize: 5 * 1024 * 1024 * 1024, // 5 GB
 	}
-	_, ok := replaceMap["spaceId"]
-	if !ok {
-		if fs.cacheSpaceId == "" {
-			return "", fmt.Errorf("cacheSpaceId is empty and spaceId is not provided")
-		}
-		replaceMap["spaceId"] = fs.cacheSpaceId
+}
+
+func (fs *FileService) SetRetryPolicy(policy shared.RetryPolicy) {
+	fs.retry = policy
+}
+
+// SetPoller sets how WaitForAvailable polls. The upload statuses of
+// FileService are kept when poller has no States.
+func (fs *FileService) SetPoller(poller shared.Poller) {
+	if poller.States == nil {
+		poller.States = uploadStates
 	}
+	fs.poller = poller
+}
 
-	url, ok := fs.urls[action]
-	if !ok {
-		return "", fmt.Errorf("action %s is not found", action)
+// GetUrl returns the absolute URL of action. The cached space is used when
+// replaceMap has no spaceId.
+func (fs *FileService) GetUrl(action string, replaceMap map[string]string) (string, error) {
+	if fs.baseURL == "" {
+		return "", fmt.Errorf("no base URL configured for %s", ServiceName)
 	}
 
+	params := map[string]string{}
 	for k, v := range replaceMap {
-		url = strings.Replace(url, k, v, -1)
+		params[k] = v
 	}
-	return url, nil
+	if _, ok := params["spaceId"]; !ok && fs.routes[action].HasParam("spaceId") {
+		if fs.cacheSpaceId == "" {
+			return "", fmt.Errorf("cacheSpaceId is empty and spaceId is not provided")
+		}
+		params["spaceId"] = fs.cacheSpaceId
+	}
+	return fs.routes.URL(fs.baseURL, action, params)
+}
 
+// Identity returns the backend, base URL and cached space uploads are started
+// on.
+func (fs *FileService) Identity() shared.ServiceIdentity {
+	return shared.ServiceIdentity{Name: ServiceName, BaseURL: fs.baseURL, SpaceID: fs.cacheSpaceId}
 }
 
 func (fs *FileService) CacheSpace(id string) {
@@ -70,149 +124,139 @@ func (fs *FileService) CacheSpace(id string) {
 }
 
 func (fs *FileService) CreateFolder(parentId string) (string, error) {
-	jsonData := map[string]interface{}{
-		"parentId": parentId,
-		"name":     shared.GenerateRandomString(5),
-	}
-	jsonBytes, err := json.Marshal(jsonData)
+	return fs.CreateFolderContext(context.Background(), parentId)
+}
+
+func (fs *FileService) CreateFolderContext(ctx context.Context, parentId string) (string, error) {
+	return fs.CreateNamedFolderContext(ctx, parentId, shared.GenerateRandomString(5))
+}
+
+// CreateNamedFolder creates the folder name in parentId. CreateFolder picks a
+// random name instead.
+func (fs *FileService) CreateNamedFolder(parentId string, name string) (string, error) {
+	return fs.CreateNamedFolderContext(context.Background(), parentId, name)
+}
+
+func (fs *FileService) CreateNamedFolderContext(ctx context.Context, parentId string, name string) (string, error) {
+	jsonBytes, err := json.Marshal(Folder{Name: name, ParentID: parentId})
 	if err != nil {
-		log.Panic(err)
+		return "", err
 	}
 	url, err := fs.GetUrl("createFolder", nil)
 	if err != nil {
-		log.Panic(err)
+		return "", err
 	}
-	// fmt.Println(url)
-	resp, err := shared.Request(fs.GetClient(), "POST", url, &jsonBytes, nil)
+	resp, err := shared.RequestContext(ctx, fs.GetClient(), fs.GetCredentials(), "POST", url, &jsonBytes, nil, shared.RequestOptions{Retry: fs.GetRetryPolicy()})
 	if err != nil {
-		log.Panic(err)
+		return "", err
 	}
-	if resp.StatusCode == http.StatusCreated {
-		fmt.Println("JSON request successful")
-	} else {
-		var result map[string]interface{}
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		_ = json.Unmarshal(bodyBytes, &result)
-		fmt.Printf("JSON request failed with status: %s\n", bodyBytes)
-	}
-
-	id, err := fs.ExtractCreateFolderResp(resp)
-	if err != nil {
-		log.Panic(err)
-
+	if resp.StatusCode != http.StatusCreated {
+		return "", shared.NewAPIError(resp)
 	}
-	return id, nil
-
+	return fs.ExtractCreateFolderResp(resp)
 }
 
-func (fs *FileService) createSpace() *http.Response {
-	jsonData := map[string]interface{}{
-		"space": map[string]interface{}{
-			"name":      "test-space",
-			"provider":  "aws",
-			"accountId": "123456789",
-			"acl": map[string]interface{}{
-				"ContentManager": []string{"trn:tid:application:a46ca581-f699-4b3a-a2c2-0f177015d599"},
-			},
+// createSpace creates a space managed by the OAuth client of the environment.
+func (fs *FileService) createSpace() (*http.Response, error) {
+	if fs.clientID == "" {
+		return nil, fmt.Errorf("no client id configured to manage the space")
+	}
+	jsonBytes, err := json.Marshal(SpaceRequest{Space: Space{
+		Name:      "test-space",
+		Provider:  "aws",
+		AccountID: "123456789",
+		ACL: map[string][]string{
+			"ContentManager": {"trn:tid:application:" + fs.clientID},
 		},
+	}})
+	if err != nil {
+		return nil, err
 	}
-	jsonBytes, err := json.Marshal(jsonData)
+	url, err := fs.GetUrl("createSpace", nil)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	resp, err := shared.Request(fs.GetClient(), "POST", "*/spaces?complete=True", &jsonBytes, nil)
-
-	if resp.StatusCode == http.StatusCreated {
-		fmt.Println("JSON request successful")
-	} else {
-		var result map[string]interface{}
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		_ = json.Unmarshal(bodyBytes, &result)
-		fmt.Printf("JSON request failed with status: %s\n", bodyBytes)
+	resp, err := shared.Request(fs.GetClient(), fs.GetCredentials(), "POST", url, &jsonBytes, nil, shared.RequestOptions{Retry: fs.GetRetryPolicy()})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, shared.NewAPIError(resp)
 	}
-	return resp
+	return resp, nil
 }
 
 func (*FileService) ExtractCreateFileResp(resp *http.Response) (string, string, string, error) {
-	var result map[string]interface{}
 	defer resp.Body.Close()
-	if resp.Body != nil {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", "", "", err
-		}
-		err = json.Unmarshal(bodyBytes, &result)
-		if err != nil {
-			return "", "", "", err
-		}
-		if fileInput, ok := result["fileInputUploadDetails"].(map[string]interface{}); ok {
-			uploadUrl, ok := fileInput["upload"].(map[string]interface{})
-			if ok {
-				fmt.Printf("File upload Id: %s  and file Id: %s\n", result["id"], fileInput["fileId"])
-				return result["id"].(string), uploadUrl["url"].(string), fileInput["fileId"].(string), nil
-			}
-		}
+	var result Upload
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", "", "", fmt.Errorf("%w: %v", shared.ErrInvalidResponse, err)
 	}
-	return "", "", "", fmt.Errorf("Response body is nil")
+	details := result.FileInputUploadDetails
+	if result.ID == "" || details == nil || details.FileID == "" || details.Upload.URL == "" {
+		return "", "", "", fmt.Errorf("%w: upload response has no id, upload url or file id", shared.ErrInvalidResponse)
+	}
+	return result.ID, details.Upload.URL, details.FileID, nil
 }
 
 func (*FileService) ExtractCreateFolderResp(resp *http.Response) (string, error) {
-	var result map[string]interface{}
 	defer resp.Body.Close()
-	if resp.Body != nil {
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
-		}
-		err = json.Unmarshal(bodyBytes, &result)
-		if err != nil {
-			return "", err
-		}
-		return result["id"].(string), nil
+	var result Folder
+	err := json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", shared.ErrInvalidResponse, err)
 	}
-	return "", fmt.Errorf("Response body is nil")
+	if result.ID == "" {
+		return "", fmt.Errorf("%w: folder response has no id", shared.ErrInvalidResponse)
+	}
+	return result.ID, nil
 }
 
 func (fs *FileService) WaitForAvailable(resourceId string) error {
-	url, err := fs.GetUrl("getUpload", map[string]string{"uploadId": resourceId})
-	if err != nil {
-		return err
-	}
-
-	for {
-		time.Sleep(5 * time.Second)
-		resp, err := shared.Request(
-			fs.GetClient(), "GET", url, nil, nil)
+	return fs.WaitForAvailableContext(context.Background(), resourceId)
+}
 
+func (fs *FileService) WaitForAvailableContext(ctx context.Context, resourceId string) error {
+	return fs.poller.Wait(ctx, "upload "+resourceId, func(ctx context.Context) (string, error) {
+		upload, err := fs.upload(ctx, resourceId)
 		if err != nil {
-			return err
+			return "", err
 		}
-		defer resp.Body.Close()
-		if resp.Body != nil {
-			bodyBytes, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Panic(err)
-			}
-			var result map[string]interface{}
-			err = json.Unmarshal(bodyBytes, &result)
-			if err != nil {
-				return err
-			}
-			if resp.StatusCode == http.StatusOK {
-				if result, ok := result["result"].(map[string]interface{}); ok {
-					if status, ok := result["status"]; ok && status == "COMPLETED" {
-						fmt.Println("File is available")
-						return nil
-					}
-				}
-			} else {
-				return fmt.Errorf("Bad request on waiting for file: %d", resp.StatusCode)
-			}
+		// The result is only set once the upload is processed.
+		if upload.Result == nil {
+			return string(UploadStatusPending), nil
 		}
+		return string(upload.Result.Status), nil
+	})
+}
+
+func (fs *FileService) upload(ctx context.Context, uploadId string) (Upload, error) {
+	url, err := fs.GetUrl("getUpload", map[string]string{"uploadId": uploadId})
+	if err != nil {
+		return Upload{}, err
+	}
+	resp, err := shared.RequestContext(ctx, fs.GetClient(), fs.GetCredentials(), "GET", url, nil, nil, shared.RequestOptions{Retry: fs.GetRetryPolicy()})
+	if err != nil {
+		return Upload{}, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		return Upload{}, shared.NewAPIError(resp)
+	}
+	defer resp.Body.Close()
+	var result Upload
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return Upload{}, fmt.Errorf("%w: %v", shared.ErrInvalidResponse, err)
+	}
+	return result, nil
 }
 
 func (fs *FileService) Assemble(id string, parts []shared.AssembleTag) error {
+	return fs.AssembleContext(context.Background(), id, parts)
+}
+
+func (fs *FileService) AssembleContext(ctx context.Context, id string, parts []shared.AssembleTag) error {
 
 	page := AssemblyPage{
 		Etags: parts,
@@ -223,21 +267,60 @@ func (fs *FileService) Assemble(id string, parts []shared.AssembleTag) error {
 	if err != nil {
 		return err
 	}
-	fmt.Println(string(s))
 	url, err := fs.GetUrl("assembleFile", map[string]string{"resourceId": id})
 	if err != nil {
 		return err
 	}
 
-	resp, err := shared.Request(fs.GetClient(), "PATCH", url, &s, nil)
+	resp, err := shared.RequestContext(ctx, fs.GetClient(), fs.GetCredentials(), "PATCH", url, &s, nil, shared.RequestOptions{Retry: fs.GetRetryPolicy()})
 	if err != nil {
 		return err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Assemble request failed with status: %d\n", resp.StatusCode)
+		return shared.NewAPIError(resp)
+	}
+	resp.Body.Close()
+	return nil
+
+}
+
+// Abort deletes an upload that will not be completed.
+func (fs *FileService) Abort(id string) error {
+	return fs.AbortContext(context.Background(), id)
+}
+
+func (fs *FileService) AbortContext(ctx context.Context, id string) error {
+	url, err := fs.GetUrl("abortUpload", map[string]string{"uploadId": id})
+	if err != nil {
+		return err
 	}
+	resp, err := shared.RequestContext(ctx, fs.GetClient(), fs.GetCredentials(), "DELETE", url, nil, nil, shared.RequestOptions{Retry: fs.GetRetryPolicy()})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
 	return nil
+}
 
+// Delete deletes a file of the cached space.
+func (fs *FileService) Delete(fileId string) error {
+	return fs.DeleteContext(context.Background(), fileId)
+}
+
+func (fs *FileService) DeleteContext(ctx context.Context, fileId string) error {
+	url, err := fs.GetUrl("deleteFile", map[string]string{"fileId": fileId})
+	if err != nil {
+		return err
+	}
+	resp, err := shared.RequestContext(ctx, fs.GetClient(), fs.GetCredentials(), "DELETE", url, nil, nil, shared.RequestOptions{Retry: fs.GetRetryPolicy()})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return shared.NewAPIError(resp)
+	}
+	resp.Body.Close()
+	return nil
 }
 
 func (fs *FileService) CreateTag(etag string, partNumber int) shared.AssembleTag {
@@ -249,10 +332,85 @@ func (fs *FileService) CreateTag(etag string, partNumber int) shared.AssembleTag
 	}
 }
 
-func (do *FileService) CheckIfMultipart(payload map[string]interface{}) (bool, error) {
-	if multipart, ok := payload["multipart"]; !ok || multipart.(bool) == false {
-		return false, nil
-	} else {
-		return true, nil
+// WrapPayload adapts a map payload, whose fields are at the top level.
+func (fs *FileService) WrapPayload(fields map[string]interface{}) shared.Payload {
+	return &shared.MapPayload{Fields: fields}
+}
+
+// MD5ETags reports that FileService part ETags are the MD5 of the part.
+func (fs *FileService) MD5ETags() bool {
+	return true
+}
+
+// FileChecksum returns the SHA-256 FileService stored for the file, or "" when
+// it has none.
+func (fs *FileService) FileChecksum(ctx context.Context, fileId string) (string, error) {
+	file, err := fs.file(ctx, fileId)
+	if err != nil {
+		return "", err
+	}
+	return file.SHA256, nil
+}
+
+// DownloadInfo returns the download URL, size and SHA-256 of a file in the
+// cached space.
+func (fs *FileService) DownloadInfo(ctx context.Context, fileId string) (shared.DownloadInfo, error) {
+	file, err := fs.file(ctx, fileId)
+	if err != nil {
+		return shared.DownloadInfo{}, err
+	}
+	if file.Download == nil {
+		return shared.DownloadInfo{}, fmt.Errorf("%w: file %s has no download URL", shared.ErrInvalidResponse, fileId)
+	}
+	return shared.DownloadInfo{URL: file.Download.URL, Size: file.Size, SHA256: file.SHA256}, nil
+}
+
+// Stat returns the metadata of a file of the cached space.
+func (fs *FileService) Stat(fileId string) (File, error) {
+	return fs.file(context.Background(), fileId)
+}
+
+func (fs *FileService) StatContext(ctx context.Context, fileId string) (File, error) {
+	return fs.file(ctx, fileId)
+}
+
+// ListFiles returns the active files in the folder folderId of the cached
+// space.
+func (fs *FileService) ListFiles(folderId string) ([]File, error) {
+	return fs.ListFilesContext(context.Background(), folderId)
+}
+
+func (fs *FileService) ListFilesContext(ctx context.Context, folderId string) ([]File, error) {
+	url, err := fs.GetUrl("listFiles", map[string]string{"folderId": folderId})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := shared.RequestContext(ctx, fs.GetClient(), fs.GetCredentials(), "GET", url, nil, nil, shared.RequestOptions{Retry: fs.GetRetryPolicy()})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, shared.NewAPIError(resp)
+	}
+	defer resp.Body.Close()
+	var result FileList
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", shared.ErrInvalidResponse, err)
+	}
+	return result.Items, nil
+}
+
+func (fs *FileService) file(ctx context.Context, fileId string) (File, error) {
+	resp, err := shared.GetFileContext(ctx, fs, fileId, nil)
+	if err != nil {
+		return File{}, err
+	}
+	defer resp.Body.Close()
+	var result File
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return File{}, fmt.Errorf("%w: %v", shared.ErrInvalidResponse, err)
 	}
+	return result, nil
 }
@@ -0,0 +1,326 @@
+package fileservice_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/osga1291/upload/fileservice"
+	"github.com/osga1291/upload/fileservice/fileservicetest"
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+func newServer(t *testing.T) (*fileservicetest.Server, *fileservice.FileService, string) {
+	server := fileservicetest.NewServer()
+	t.Cleanup(server.Close)
+	spaceId := server.CreateSpace("test")
+	return server, server.Client(spaceId), spaceId
+}
+
+func TestCreateFolder(t *testing.T) {
+	server, fs, spaceId := newServer(t)
+
+	parentId, err := fs.CreateFolder(spaceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childId, err := fs.CreateFolder(parentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, ok := server.Folder(childId)
+	if !ok || child.ParentID != parentId {
+		t.Fatalf("folder is %+v", child)
+	}
+
+	_, err = fs.CreateFolder("missing")
+	if !errors.Is(err, shared.ErrNotFound) {
+		t.Fatalf("missing parent: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestSinglepartUpload(t *testing.T) {
+	server, fs, spaceId := newServer(t)
+	file, content := sharedtest.TempFile(t, 300*1024)
+
+	fileId, err := shared.Upload(fs, fileservice.NewUploadRequest("single.bin", spaceId), nil, file, shared.UploadOptions{VerifyChecksum: true, Checksum: shared.ChecksumMD5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, ok := server.Content(fileId)
+	if !ok || !bytes.Equal(stored, content) {
+		t.Fatalf("stored content differs from the source")
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	server, fs, spaceId := newServer(t)
+	folderId, err := fs.CreateFolder(spaceId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, content := sharedtest.TempFile(t, 11*1024*1024)
+
+	payload := fileservice.NewUploadRequest("multi.bin", folderId).Multipart()
+	fileId, err := shared.Upload(fs, payload, nil, file, shared.UploadOptions{ChunkSize: 5 * 1024 * 1024, MaxRoutines: 3, VerifyChecksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, ok := server.Content(fileId)
+	if !ok || !bytes.Equal(stored, content) {
+		t.Fatalf("stored content differs from the source")
+	}
+}
+
+func TestUploadProcessingFailed(t *testing.T) {
+	server, fs, spaceId := newServer(t)
+	server.FailProcessing = func(req fileservicetest.UploadRequest) bool { return req.Name == "broken.zip" }
+	file, _ := sharedtest.TempFile(t, 1024)
+
+	_, err := shared.Upload(fs, fileservice.NewUploadRequest("broken.zip", spaceId), nil, file)
+	if !errors.Is(err, shared.ErrProcessingFailed) {
+		t.Fatalf("got %v, want ErrProcessingFailed", err)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	_, fs, spaceId := newServer(t)
+	file, content := sharedtest.TempFile(t, 1024*1024+17)
+	fileId, err := shared.Upload(fs, fileservice.NewUploadRequest("download.bin", spaceId), nil, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := os.Create(filepath.Join(t.TempDir(), "download"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	err = shared.Download(fs, fileId, dst, shared.UploadOptions{ChunkSize: 100 * 1024, MaxRoutines: 4, VerifyChecksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("downloaded content differs from the upload")
+	}
+}
+
+func TestListStatDelete(t *testing.T) {
+	_, fs, spaceId := newServer(t)
+	file, _ := sharedtest.TempFile(t, 1024)
+
+	folderId, err := fs.CreateNamedFolder(spaceId, "reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, name := range []string{"b.bin", "a.bin"} {
+		file.Seek(0, 0)
+		id, err := shared.Upload(fs, fileservice.NewUploadRequest(name, folderId), nil, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	file.Seek(0, 0)
+	_, err = shared.Upload(fs, fileservice.NewUploadRequest("c.bin", spaceId), nil, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := fs.ListFiles(folderId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].Name != "a.bin" || files[1].Name != "b.bin" {
+		t.Fatalf("listed %+v", files)
+	}
+
+	meta, err := fs.Stat(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Name != "b.bin" || meta.ParentID != folderId || meta.Size != 1024 {
+		t.Fatalf("stat is %+v", meta)
+	}
+
+	err = fs.Delete(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Stat(ids[0])
+	if !errors.Is(err, shared.ErrNotFound) {
+		t.Fatalf("deleted file: got %v, want ErrNotFound", err)
+	}
+	_, err = fs.ListFiles("missing")
+	if !errors.Is(err, shared.ErrNotFound) {
+		t.Fatalf("missing folder: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestUploadRequest(t *testing.T) {
+	server, fs, spaceId := newServer(t)
+	createUrl, err := fs.GetUrl(shared.RouteCreateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		payload func() shared.Payload
+		want    string
+	}{
+		{"singlepart", func() shared.Payload { return fileservice.NewUploadRequest("a.bin", spaceId) },
+			`{"name":"a.bin","parentId":"` + spaceId + `"}`},
+		{"multipart", func() shared.Payload { return fileservice.NewUploadRequest("a.bin", spaceId).Multipart() },
+			`{"name":"a.bin","parentId":"` + spaceId + `","multipart":true}`},
+		{"multipart cleared", func() shared.Payload {
+			p := fileservice.NewUploadRequest("a.bin", spaceId).Multipart()
+			p.SetMultipart(false)
+			return p
+		}, `{"name":"a.bin","parentId":"` + spaceId + `"}`},
+		{"checksum", func() shared.Payload {
+			p := fileservice.NewUploadRequest("a.bin", spaceId)
+			p.SetChecksum("abc")
+			return p
+		}, `{"name":"a.bin","parentId":"` + spaceId + `","sha256":"abc"}`},
+		{"map", func() shared.Payload {
+			p := fs.WrapPayload(map[string]interface{}{"name": "a.bin", "parentId": spaceId})
+			p.SetMultipart(true)
+			return p
+		}, `{"multipart":true,"name":"a.bin","parentId":"` + spaceId + `"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload := test.payload()
+			b, err := json.Marshal(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != test.want {
+				t.Fatalf("got %s, want %s", b, test.want)
+			}
+
+			// The fake decodes the body strictly into the request it documents.
+			resp, err := shared.CreateFile(fs, payload, createUrl, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			uploadId, _, _, err := fs.ExtractCreateFileResp(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want fileservicetest.UploadRequest
+			err = json.Unmarshal([]byte(test.want), &want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, _ := server.Upload(uploadId)
+			if got != want {
+				t.Errorf("created %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestAbortCompletedUpload(t *testing.T) {
+	_, fs, spaceId := newServer(t)
+	createUrl, err := fs.GetUrl(shared.RouteCreateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := shared.CreateFile(fs, fileservice.NewUploadRequest("aborted.bin", spaceId), createUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadId, uploadUrl, fileId, err := fs.ExtractCreateFileResp(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("PUT", uploadUrl, bytes.NewReader([]byte("content")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	err = fs.WaitForAvailable(uploadId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Abort(uploadId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.Stat(fileId)
+	if !errors.Is(err, shared.ErrNotFound) {
+		t.Fatalf("file of an aborted upload: got %v, want ErrNotFound", err)
+	}
+	files, err := fs.ListFiles(spaceId)
+	if err != nil || len(files) != 0 {
+		t.Fatalf("listed %+v, %v, want no files", files, err)
+	}
+}
+
+// TestContract checks that the server rejects bodies in shapes FileService
+// does not accept, which is what keeps the tests above honest.
+func TestContract(t *testing.T) {
+	server, fs, spaceId := newServer(t)
+	createUrl, err := fs.GetUrl(shared.RouteCreateFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body interface{}
+	}{
+		{"unknown field", map[string]interface{}{"name": "a", "parentId": spaceId, "fileset": true}},
+		{"missing parent", map[string]interface{}{"name": "a"}},
+		{"nested under file", map[string]interface{}{"file": map[string]interface{}{"name": "a", "parentId": spaceId}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, _ := json.Marshal(test.body)
+			_, err := shared.Request(fs.GetClient(), fs.GetCredentials(), "POST", createUrl, &body, nil)
+			var apiErr *shared.APIError
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+				t.Fatalf("got %v, want a 400", err)
+			}
+		})
+	}
+
+	// DataOcean names the part number part_number; FileService does not.
+	resp, err := shared.CreateFile(fs, fileservice.NewUploadRequest("a", spaceId).Multipart(), createUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadId, _, _, err := fs.ExtractCreateFileResp(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assembleUrl, err := fs.GetUrl("assembleFile", map[string]string{"resourceId": uploadId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"parts":[{"etag":"abc","part_number":1}]}`)
+	_, err = shared.Request(fs.GetClient(), fs.GetCredentials(), "PATCH", assembleUrl, &body, nil)
+	if err == nil {
+		t.Fatalf("assemble with part_number succeeded")
+	}
+	if _, _, ok := server.Upload(uploadId); !ok {
+		t.Fatalf("upload %s is gone", uploadId)
+	}
+}
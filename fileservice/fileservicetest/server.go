@@ -0,0 +1,542 @@
+// Package fileservicetest runs an in-memory FileService, with its presigned
+// upload URLs and an OAuth token endpoint, so clients can be tested offline.
+//
+// Request bodies are decoded strictly into the shapes FileService documents,
+// which are declared here rather than taken from package fileservice, and
+// required fields and query parameters are checked, so a client that drifts
+// from them gets a 400 rather than a passing test.
+package fileservicetest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/osga1291/upload/fileservice"
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+// The client credentials accepted by the token endpoint.
+const (
+	ClientID     = "fileservicetest-client"
+	ClientSecret = "fileservicetest-secret"
+)
+
+// Server is a fake FileService. It serves:
+//
+//	POST   /spaces?complete=True                          create a space
+//	POST   /spaces/{spaceId}/folders?complete=True        create a folder
+//	POST   /spaces/{spaceId}/uploads?complete=True        create an upload
+//	GET    /spaces/{spaceId}/uploads/{id}?complete=True   the upload, advancing its status
+//	PATCH  /spaces/{spaceId}/uploads/{id}?complete=True   assemble the uploaded parts
+//	DELETE /spaces/{spaceId}/uploads/{id}                 abort the upload
+//	GET    /spaces/{spaceId}/folders/{id}/files?status=active  the completed files of a folder
+//	GET    /spaces/{spaceId}/files/{id}?status=active     a completed file
+//	DELETE /spaces/{spaceId}/files/{id}                   delete a completed file
+//
+// together with the presigned URLs of sharedtest.Blobs and the token endpoint
+// of sharedtest.OAuth at sharedtest.TokenPath. A space is also a folder: its
+// id can be the parent of folders and uploads.
+type Server struct {
+	*httptest.Server
+	OAuth *sharedtest.OAuth
+	Blobs *sharedtest.Blobs
+	// PendingPolls is how many times an upload whose content is complete is
+	// still reported PENDING before it is processed.
+	PendingPolls int
+	// FailProcessing makes the uploads it returns true for end up FAILED.
+	// Uploads whose content does not match the sha256 they were created with
+	// always do.
+	FailProcessing func(req UploadRequest) bool
+
+	mutex   sync.Mutex
+	spaces  map[string]space
+	folders map[string]Folder
+	uploads map[string]*upload
+	// files maps the id of a file to the id of its upload.
+	files map[string]string
+}
+
+type upload struct {
+	spaceID string
+	fileID  string
+	request UploadRequest
+	status  string
+	polls   int
+}
+
+// The statuses of an upload whose content is complete.
+const (
+	statusPending   = "PENDING"
+	statusCompleted = "COMPLETED"
+	statusFailed    = "FAILED"
+)
+
+// Folder is the body that creates a folder and the folder returned.
+type Folder struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name"`
+	ParentID string `json:"parentId"`
+}
+
+// UploadRequest is the body that creates an upload.
+type UploadRequest struct {
+	Name      string `json:"name"`
+	ParentID  string `json:"parentId"`
+	Multipart bool   `json:"multipart,omitempty"`
+	SHA256    string `json:"sha256,omitempty"`
+}
+
+type space struct {
+	ID        string              `json:"id,omitempty"`
+	Name      string              `json:"name"`
+	Provider  string              `json:"provider"`
+	AccountID string              `json:"accountId"`
+	ACL       map[string][]string `json:"acl,omitempty"`
+}
+
+type spaceRequest struct {
+	Space space `json:"space"`
+}
+
+type uploadResponse struct {
+	ID                     string         `json:"id"`
+	FileInputUploadDetails *uploadDetails `json:"fileInputUploadDetails,omitempty"`
+	Result                 *uploadResult  `json:"result,omitempty"`
+}
+
+type uploadDetails struct {
+	FileID string `json:"fileId"`
+	Upload struct {
+		URL string `json:"url"`
+	} `json:"upload"`
+}
+
+type uploadResult struct {
+	Status string `json:"status"`
+}
+
+type fileResponse struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ParentID string `json:"parentId"`
+	SHA256   string `json:"sha256"`
+	Size     int64  `json:"size"`
+	Download struct {
+		URL string `json:"url"`
+	} `json:"download"`
+}
+
+type fileList struct {
+	Items []fileResponse `json:"items"`
+}
+
+// NewServer starts a Server. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		OAuth:        sharedtest.NewOAuth(ClientID, ClientSecret),
+		Blobs:        sharedtest.NewBlobs(),
+		PendingPolls: 1,
+		spaces:       map[string]space{},
+		folders:      map[string]Folder{},
+		uploads:      map[string]*upload{},
+		files:        map[string]string{},
+	}
+	mux := http.NewServeMux()
+	mux.Handle(sharedtest.TokenPath, s.OAuth)
+	mux.Handle(sharedtest.BlobsPath, s.Blobs)
+	mux.Handle("/spaces", s.OAuth.Authorize(http.HandlerFunc(s.createSpace)))
+	mux.Handle("/spaces/", s.OAuth.Authorize(http.HandlerFunc(s.serveSpace)))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Environment returns the environment pointing at s.
+func (s *Server) Environment() shared.Environment {
+	return shared.Environment{
+		Name:     "fileservicetest",
+		BaseURLs: map[string]string{fileservice.ServiceName: s.URL},
+		TokenURL: s.URL + sharedtest.TokenPath,
+		ClientID: ClientID,
+	}
+}
+
+// Credentials returns client credentials accepted by s.
+func (s *Server) Credentials() *shared.ClientCredentials {
+	return s.Environment().Credentials(ClientID, ClientSecret)
+}
+
+// Client returns a FileService client for s using spaceId that polls and
+// retries with short delays.
+func (s *Server) Client(spaceId string) *fileservice.FileService {
+	fs := fileservice.NewFileService(s.Environment(), s.Credentials())
+	fs.CacheSpace(spaceId)
+	fs.SetPoller(shared.Poller{
+		InitialInterval: time.Millisecond,
+		MaxInterval:     10 * time.Millisecond,
+		Multiplier:      2,
+		Timeout:         10 * time.Second,
+	})
+	policy := shared.DefaultRetryPolicy
+	policy.BaseDelay = time.Millisecond
+	policy.MaxDelay = 10 * time.Millisecond
+	fs.SetRetryPolicy(policy)
+	return fs
+}
+
+// CreateSpace adds a space called name and returns its id.
+func (s *Server) CreateSpace(name string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	space := space{ID: sharedtest.RandomID(8), Name: name, Provider: "aws"}
+	s.spaces[space.ID] = space
+	return space.ID
+}
+
+// Folder returns the folder id.
+func (s *Server) Folder(id string) (Folder, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	folder, ok := s.folders[id]
+	return folder, ok
+}
+
+// Upload returns the request the upload id was created with and its status,
+// which is empty until its content is complete.
+func (s *Server) Upload(id string) (UploadRequest, string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u, ok := s.uploads[id]
+	if !ok {
+		return UploadRequest{}, "", false
+	}
+	return u.request, u.status, true
+}
+
+// Content returns the content of the file id once its upload is complete.
+func (s *Server) Content(fileId string) ([]byte, bool) {
+	s.mutex.Lock()
+	uploadId, ok := s.files[fileId]
+	s.mutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return s.Blobs.Content(uploadId)
+}
+
+func (s *Server) createSpace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireQuery(w, r, "complete", "true") {
+		return
+	}
+	var req spaceRequest
+	if !decode(w, r, &req) {
+		return
+	}
+	space := req.Space
+	if !required(w, map[string]string{"space.name": space.Name, "space.provider": space.Provider, "space.accountId": space.AccountID}) {
+		return
+	}
+	if space.ID != "" {
+		badRequest(w, "space.id is assigned by the server")
+		return
+	}
+	space.ID = sharedtest.RandomID(8)
+	s.mutex.Lock()
+	s.spaces[space.ID] = space
+	s.mutex.Unlock()
+	sharedtest.WriteJSON(w, http.StatusCreated, space)
+}
+
+// serveSpace routes the requests under /spaces/{spaceId}/.
+func (s *Server) serveSpace(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/spaces/"), "/")
+	s.mutex.Lock()
+	_, ok := s.spaces[path[0]]
+	s.mutex.Unlock()
+	if !ok {
+		notFound(w, "space "+path[0])
+		return
+	}
+
+	switch {
+	case len(path) == 2 && path[1] == "folders" && r.Method == http.MethodPost:
+		s.createFolder(w, r, path[0])
+	case len(path) == 2 && path[1] == "uploads" && r.Method == http.MethodPost:
+		s.createUpload(w, r, path[0])
+	case len(path) == 3 && path[1] == "uploads":
+		s.serveUpload(w, r, path[0], path[2])
+	case len(path) == 4 && path[1] == "folders" && path[3] == "files" && r.Method == http.MethodGet:
+		s.listFiles(w, r, path[0], path[2])
+	case len(path) == 3 && path[1] == "files" && r.Method == http.MethodGet:
+		s.getFile(w, r, path[0], path[2])
+	case len(path) == 3 && path[1] == "files" && r.Method == http.MethodDelete:
+		s.deleteFile(w, path[0], path[2])
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *Server) createFolder(w http.ResponseWriter, r *http.Request, spaceId string) {
+	if !requireQuery(w, r, "complete", "true") {
+		return
+	}
+	var folder Folder
+	if !decode(w, r, &folder) || !required(w, map[string]string{"name": folder.Name, "parentId": folder.ParentID}) {
+		return
+	}
+	if folder.ID != "" {
+		badRequest(w, "id is assigned by the server")
+		return
+	}
+	if !s.parentExists(w, spaceId, folder.ParentID) {
+		return
+	}
+	folder.ID = sharedtest.RandomID(8)
+	s.mutex.Lock()
+	s.folders[folder.ID] = folder
+	s.mutex.Unlock()
+	sharedtest.WriteJSON(w, http.StatusCreated, folder)
+}
+
+func (s *Server) createUpload(w http.ResponseWriter, r *http.Request, spaceId string) {
+	if !requireQuery(w, r, "complete", "true") {
+		return
+	}
+	var req UploadRequest
+	if !decode(w, r, &req) || !required(w, map[string]string{"name": req.Name, "parentId": req.ParentID}) {
+		return
+	}
+	if !s.parentExists(w, spaceId, req.ParentID) {
+		return
+	}
+
+	u := &upload{spaceID: spaceId, fileID: sharedtest.RandomID(8), request: req}
+	id := sharedtest.RandomID(8)
+	s.mutex.Lock()
+	s.uploads[id] = u
+	s.mutex.Unlock()
+
+	details := &uploadDetails{FileID: u.fileID}
+	details.Upload.URL = s.Blobs.Create(s.URL, id, req.Multipart)
+	sharedtest.WriteJSON(w, http.StatusCreated, uploadResponse{ID: id, FileInputUploadDetails: details})
+}
+
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, spaceId string, id string) {
+	s.mutex.Lock()
+	u, ok := s.uploads[id]
+	s.mutex.Unlock()
+	if !ok || u.spaceID != spaceId {
+		notFound(w, "upload "+id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !requireQuery(w, r, "complete", "true") {
+			return
+		}
+		sharedtest.WriteJSON(w, http.StatusOK, s.poll(id))
+	case http.MethodPatch:
+		if !requireQuery(w, r, "complete", "true") {
+			return
+		}
+		s.assemble(w, r, id)
+	case http.MethodDelete:
+		// Aborting an assembled upload deletes its file too.
+		s.mutex.Lock()
+		delete(s.uploads, id)
+		if s.files[u.fileID] == id {
+			delete(s.files, u.fileID)
+		}
+		s.mutex.Unlock()
+		s.Blobs.Delete(id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) assemble(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		Parts []struct {
+			Etag       string `json:"etag"`
+			PartNumber int    `json:"partNumber"`
+		} `json:"parts"`
+	}
+	if !decode(w, r, &req) {
+		return
+	}
+	parts := make([]sharedtest.Part, len(req.Parts))
+	for i, p := range req.Parts {
+		if p.Etag == "" || p.PartNumber < 1 {
+			badRequest(w, "every part needs an etag and a partNumber")
+			return
+		}
+		parts[i] = sharedtest.Part{PartNumber: p.PartNumber, Etag: p.Etag}
+	}
+	err := s.Blobs.Assemble(id, parts)
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	sharedtest.WriteJSON(w, http.StatusOK, s.poll(id))
+}
+
+func (s *Server) getFile(w http.ResponseWriter, r *http.Request, spaceId string, fileId string) {
+	if !requireQuery(w, r, "status", "active") {
+		return
+	}
+	s.mutex.Lock()
+	uploadId, u := s.file(spaceId, fileId)
+	s.mutex.Unlock()
+	if u == nil {
+		notFound(w, "file "+fileId)
+		return
+	}
+	sharedtest.WriteJSON(w, http.StatusOK, s.fileMeta(fileId, uploadId, u))
+}
+
+func (s *Server) listFiles(w http.ResponseWriter, r *http.Request, spaceId string, folderId string) {
+	if !requireQuery(w, r, "status", "active") || !s.parentExists(w, spaceId, folderId) {
+		return
+	}
+	files := []fileResponse{}
+	s.mutex.Lock()
+	for fileId := range s.files {
+		uploadId, u := s.file(spaceId, fileId)
+		if u != nil && u.request.ParentID == folderId {
+			files = append(files, s.fileMeta(fileId, uploadId, u))
+		}
+	}
+	s.mutex.Unlock()
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	sharedtest.WriteJSON(w, http.StatusOK, fileList{Items: files})
+}
+
+func (s *Server) deleteFile(w http.ResponseWriter, spaceId string, fileId string) {
+	s.mutex.Lock()
+	uploadId, u := s.file(spaceId, fileId)
+	if u != nil {
+		delete(s.files, fileId)
+	}
+	s.mutex.Unlock()
+	if u == nil {
+		notFound(w, "file "+fileId)
+		return
+	}
+	s.Blobs.Delete(uploadId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// file returns the upload of the completed file fileId of the space spaceId,
+// or nil. s.mutex must be held.
+func (s *Server) file(spaceId string, fileId string) (string, *upload) {
+	uploadId := s.files[fileId]
+	u, ok := s.uploads[uploadId]
+	if !ok || u.spaceID != spaceId {
+		return "", nil
+	}
+	return uploadId, u
+}
+
+func (s *Server) fileMeta(fileId string, uploadId string, u *upload) fileResponse {
+	content, _ := s.Blobs.Content(uploadId)
+	meta := fileResponse{
+		ID:       fileId,
+		Name:     u.request.Name,
+		ParentID: u.request.ParentID,
+		SHA256:   sharedtest.SHA256(content),
+		Size:     int64(len(content)),
+	}
+	meta.Download.URL = s.Blobs.DownloadURL(s.URL, uploadId)
+	return meta
+}
+
+// poll returns the upload id as a GET reports it. Once its content is
+// complete the upload stays PENDING for PendingPolls polls and is then
+// processed; a completed upload makes its file active.
+func (s *Server) poll(id string) uploadResponse {
+	content, complete := s.Blobs.Content(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	u := s.uploads[id]
+	if complete && u.status == "" {
+		u.status = statusPending
+	}
+	if u.status == statusPending {
+		u.polls++
+		if u.polls > s.PendingPolls {
+			sum := sharedtest.SHA256(content)
+			if (u.request.SHA256 != "" && u.request.SHA256 != sum) || (s.FailProcessing != nil && s.FailProcessing(u.request)) {
+				u.status = statusFailed
+			} else {
+				u.status = statusCompleted
+				s.files[u.fileID] = id
+			}
+		}
+	}
+
+	result := uploadResponse{ID: id, FileInputUploadDetails: &uploadDetails{FileID: u.fileID}}
+	if u.status != "" {
+		result.Result = &uploadResult{Status: u.status}
+	}
+	return result
+}
+
+// parentExists answers 404 and returns false when parentId is neither the
+// space nor one of its folders.
+func (s *Server) parentExists(w http.ResponseWriter, spaceId string, parentId string) bool {
+	s.mutex.Lock()
+	_, isFolder := s.folders[parentId]
+	s.mutex.Unlock()
+	if parentId != spaceId && !isFolder {
+		notFound(w, "parent folder "+parentId)
+		return false
+	}
+	return true
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := sharedtest.DecodeJSON(r, v)
+	if err != nil {
+		badRequest(w, "invalid body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// required answers 400 and returns false when one of fields, which maps JSON
+// field names to their values, is empty.
+func required(w http.ResponseWriter, fields map[string]string) bool {
+	for name, value := range fields {
+		if value == "" {
+			badRequest(w, name+" is required")
+			return false
+		}
+	}
+	return true
+}
+
+func requireQuery(w http.ResponseWriter, r *http.Request, name string, value string) bool {
+	if !strings.EqualFold(r.URL.Query().Get(name), value) {
+		badRequest(w, "query parameter "+name+"="+value+" is required")
+		return false
+	}
+	return true
+}
+
+func badRequest(w http.ResponseWriter, message string) {
+	sharedtest.WriteJSON(w, http.StatusBadRequest, map[string]string{"message": message})
+}
+
+func notFound(w http.ResponseWriter, what string) {
+	sharedtest.WriteJSON(w, http.StatusNotFound, map[string]string{"message": what + " not found"})
+}
@@ -0,0 +1,110 @@
+package fileservice
+
+import "github.com/osga1291/upload/shared"
+
+// UploadStatus is the state of a FileService upload.
+type UploadStatus string
+
+const (
+	UploadStatusPending   UploadStatus = "PENDING"
+	UploadStatusCompleted UploadStatus = "COMPLETED"
+	UploadStatusFailed    UploadStatus = "FAILED"
+)
+
+// uploadStates tells WaitForAvailable which upload statuses end the wait.
+var uploadStates = map[string]shared.PollState{
+	string(UploadStatusPending):   shared.PollPending,
+	string(UploadStatusCompleted): shared.PollSuccess,
+	string(UploadStatusFailed):    shared.PollFailure,
+}
+
+type Space struct {
+	ID        string              `json:"id,omitempty"`
+	Name      string              `json:"name"`
+	Provider  string              `json:"provider"`
+	AccountID string              `json:"accountId"`
+	ACL       map[string][]string `json:"acl,omitempty"`
+}
+
+// SpaceRequest is the body that creates a Space.
+type SpaceRequest struct {
+	Space Space `json:"space"`
+}
+
+type Folder struct {
+	ID       string `json:"id,omitempty"`
+	Name     string `json:"name"`
+	ParentID string `json:"parentId"`
+}
+
+type File struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	ParentID string `json:"parentId"`
+	SHA256   string `json:"sha256,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	// Download is only returned for complete files.
+	Download *Download `json:"download,omitempty"`
+}
+
+// FileList is the body returned when the files of a folder are listed.
+type FileList struct {
+	Items []File `json:"items"`
+}
+
+// Download holds the presigned URL the content of a file is fetched from.
+type Download struct {
+	URL string `json:"url"`
+}
+
+// Upload is returned when an upload is created and while it is assembled.
+type Upload struct {
+	ID                     string                  `json:"id"`
+	FileInputUploadDetails *FileInputUploadDetails `json:"fileInputUploadDetails,omitempty"`
+	Result                 *UploadResult           `json:"result,omitempty"`
+}
+
+// FileInputUploadDetails tells where the content of the file being created is
+// sent. For multipart uploads the URL has a "*" in place of the part number.
+type FileInputUploadDetails struct {
+	FileID string `json:"fileId"`
+	Upload struct {
+		URL string `json:"url"`
+	} `json:"upload"`
+}
+
+type UploadResult struct {
+	Status UploadStatus `json:"status"`
+}
+
+// UploadRequest creates a file in a folder. It implements shared.Payload.
+type UploadRequest struct {
+	Name     string `json:"name"`
+	ParentID string `json:"parentId"`
+	// MultipartUpload is set with Multipart.
+	MultipartUpload bool   `json:"multipart,omitempty"`
+	SHA256          string `json:"sha256,omitempty"`
+}
+
+// NewUploadRequest starts the request for a singlepart file called name in
+// the folder parentId.
+func NewUploadRequest(name string, parentId string) *UploadRequest {
+	return &UploadRequest{Name: name, ParentID: parentId}
+}
+
+func (r *UploadRequest) Multipart() *UploadRequest {
+	r.MultipartUpload = true
+	return r
+}
+
+func (r *UploadRequest) IsMultipart() bool {
+	return r.MultipartUpload
+}
+
+func (r *UploadRequest) SetMultipart(multipart bool) {
+	r.MultipartUpload = multipart
+}
+
+func (r *UploadRequest) SetChecksum(sha256 string) {
+	r.SHA256 = sha256
+}
@@ -1,268 +1,361 @@
+// Command upload moves files to and from DataOcean and FileService:
+//
+//	upload [global flags] <command> [flags] [args]
+//
+// Run "upload help" for the commands and their flags.
 package main
 
 import (
-	"encoding/csv"
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
-	_ "net/http/pprof"
+	"math"
 	"os"
-	"sync"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/osga1291/upload/dataocean"
 	"github.com/osga1291/upload/fileservice"
 	"github.com/osga1291/upload/shared"
 )
 
-func CreateFSFile(parentId string) {
-	// Create a new FileService
-	fs := fileservice.NewFileService()
+// defaultScope is requested when the environment does not set a scope.
+const defaultScope = "oscar-test"
 
-	fs.CacheSpace("66e654cf-67cb-4b44-ba7d-4981bbe7257e")
-
-	// Create a new file
-	payload := map[string]interface{}{
-		"name":      shared.GenerateRandomString(5),
-		"parentId":  parentId,
-		"multipart": true,
-	}
+// Environment variables giving the defaults of the global flags.
+const (
+	envClientSecret = "UPLOAD_CLIENT_SECRET"
+	envSpaceID      = "UPLOAD_SPACE_ID"
+)
 
-	queryParams := map[string]string{
-		"urlDuration": "7d",
-	}
+// Exit codes, one per class of failure so that scripts can tell them apart.
+const (
+	exitOK         = 0
+	exitFailure    = 1
+	exitUsage      = 2
+	exitAuth       = 3
+	exitNotFound   = 4
+	exitTimeout    = 5
+	exitProcessing = 6 // the backend could not process the file
+	exitVerify     = 7 // checksum mismatch or file missing from a region
+	exitTransfer   = 8 // parts failed to upload or download
+)
 
-	file, err := os.Open("/Users/ogandar/Downloads/big_file_test/connect_big_file")
-	if err != nil {
-		log.Panic(err)
-	}
-	fileId, err := shared.Upload(fs, payload, queryParams, file)
-	if err != nil {
-		log.Panic(err)
-	}
-	fmt.Printf("File ID: %s\n", fileId)
+// cli holds the global flags every command runs with.
+type cli struct {
+	backend      string
+	profile      string
+	config       string
+	spaceId      string
+	clientID     string
+	clientSecret string
+	concurrency  int
+	chunkSize    byteSize
+	json         bool
+	timeout      time.Duration
+
+	// command is the command being run.
+	command *command
+	stdout  io.Writer
+	stderr  io.Writer
 }
-func CreateFSFolder(parentId string) string {
-	// Create a new FileService
-	fs := fileservice.NewFileService()
 
-	fs.CacheSpace("66e654cf-67cb-4b44-ba7d-4981bbe7257e")
+type command struct {
+	name  string
+	args  string
+	short string
+	run   func(ctx context.Context, c *cli, args []string) error
+}
 
-	id, err := fs.CreateFolder(parentId)
-	if err != nil {
-		log.Panic(err)
-	}
-	return id
+var commands = []command{
+	{"upload", "<file>", "upload a file", uploadCommand},
+	{"download", "<fileId> <dst>", "download a file", downloadCommand},
+	{"stat", "<fileId>", "show the metadata of a file", statCommand},
+	{"mkdir", "<path|name>", "create a folder", mkdirCommand},
+	{"ls", "[prefix|folderId]", "list files", lsCommand},
+	{"rm", "<fileId>...", "delete files", rmCommand},
+	{"wait", "<fileId|uploadId>", "wait until a DataOcean file or a FileService upload is available", waitCommand},
+	{"loadtest", "<file>", "upload a file many times and report throughput", loadtestCommand},
+	{"verify-regions", "<csv>", "check that the files listed in a CSV reached a region", verifyRegionsCommand},
+	{"sweep", "", "abort stale uploads left by interrupted runs", sweepCommand},
 }
 
-func CreateDOSupportFile() {
-	do := dataocean.NewDataOcean()
+// usageError is returned for a bad command line.
+type usageError struct {
+	msg string
+}
 
-	payload := map[string]interface{}{
-		"file": map[string]interface{}{
-			"path":      fmt.Sprintf("/%s/REPRESENTATION/fileVersion123/%s.png", shared.GenerateRandomString(5), shared.GenerateRandomString(5)),
-			"regions":   []string{"us1"},
-			"multipart": false,
-			"fileset":   false,
-		},
-	}
-	file, err := os.Open("/Users/ogandar/Downloads/temp.zip")
-	if err != nil {
-		log.Panic(err)
-	}
+func (e *usageError) Error() string {
+	return e.msg
+}
 
-	fileId, err := shared.Upload(do, payload, nil, file)
-	if err != nil {
-		log.Panic(err)
-	}
-	fmt.Printf("File ID: %s\n", fileId)
+func usagef(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
 }
 
-func CreateDOFile(filePath string, singlepart bool) string {
-	do := dataocean.NewDataOcean()
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
 
-	payload := map[string]interface{}{
-		"file": map[string]interface{}{
-			"path":      fmt.Sprintf("/folderA/%s", shared.GenerateRandomString(5)),
-			"regions":   []string{"us1"},
-			"multipart": !singlepart,
-			"fileset":   false,
-		},
-	}
-	file, err := os.Open(filePath)
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	c := &cli{stdout: stdout, stderr: stderr}
+	global := flag.NewFlagSet("upload", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.StringVar(&c.backend, "backend", "fileservice", "backend to talk to: dataocean or fileservice")
+	global.StringVar(&c.profile, "profile", envOr(shared.EnvProfile, "stage"), "environment profile, or $"+shared.EnvProfile)
+	global.StringVar(&c.config, "config", "", "environment config file, or $"+shared.EnvConfig)
+	global.StringVar(&c.spaceId, "space-id", os.Getenv(envSpaceID), "FileService space id, or $"+envSpaceID)
+	global.StringVar(&c.clientID, "client-id", "", "OAuth client id, or $"+shared.EnvClientID+" or the clientId of the environment")
+	global.StringVar(&c.clientSecret, "client-secret", "", "OAuth client secret, or $"+envClientSecret)
+	global.IntVar(&c.concurrency, "concurrency", 0, "parts transferred at once (default 2 per CPU)")
+	global.Var(&c.chunkSize, "chunk-size", "part size, such as 8MiB (default 50MiB)")
+	global.BoolVar(&c.json, "json", false, "write results and errors as JSON")
+	global.DurationVar(&c.timeout, "timeout", 0, "give up on the command after this long")
+	global.Usage = func() { c.usage(global) }
+
+	err := global.Parse(args)
 	if err != nil {
-		log.Panic(err)
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
 	}
-
-	fileId, err := shared.Upload(do, payload, nil, file)
-	if err != nil {
-		log.Panic(err)
+	if c.clientSecret == "" {
+		c.clientSecret = os.Getenv(envClientSecret)
 	}
-	fmt.Printf("File ID: %s\n", fileId)
-	return fileId
 
-}
-
-func GetDoFile(fileId string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	do := dataocean.NewDataOcean()
-
-	resp, err := shared.GetFile(do, fileId, nil)
-	if err != nil {
-		log.Panic(err)
+	name := global.Arg(0)
+	if name == "" || name == "help" {
+		c.usage(global)
+		if name == "" {
+			return exitUsage
+		}
+		return exitOK
 	}
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Panic(err)
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
 	}
-	var result map[string]interface{}
-	err = json.Unmarshal(bodyBytes, &result)
-	if err != nil {
-		log.Panic(err)
+	if cmd == nil {
+		return c.fail(usagef("unknown command %q, run \"upload help\"", name))
 	}
 
-	if resp.StatusCode == http.StatusOK {
-		if file, ok := result["file"].(map[string]interface{}); ok {
-			if regions, ok := file["regions"].([]interface{}); ok {
-				if len(regions) != 0 {
-					for _, region := range regions {
-						if regionStr, ok := region.(string); ok && regionStr == "eu1" {
-							fmt.Println("File is available: ", fileId)
-							return
-
-						}
-					}
-					log.Panic("File is not available: ", fileId)
-				}
-			} else {
-				log.Panic("Empty regions: ", fileId)
-			}
-		}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	c.command = cmd
+	err = cmd.run(ctx, c, global.Args()[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
 	}
+	return c.fail(err)
 }
 
-func WriteToCSV(wg *sync.WaitGroup, fileId string, writer *csv.Writer, mutex *sync.Mutex) {
-	defer wg.Done()
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	err := writer.Write([]string{fileId})
-	if err != nil {
-		log.Panic(err)
+func (c *cli) usage(global *flag.FlagSet) {
+	fmt.Fprintf(c.stderr, "Usage: upload [global flags] <command> [flags] [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(c.stderr, "  %-16s %s\n", cmd.name, cmd.short)
 	}
-
+	fmt.Fprintf(c.stderr, "\nRun \"upload <command> -h\" for the flags of a command.\n\nGlobal flags:\n")
+	global.PrintDefaults()
 }
-func ReadCSVFile(filePath string) ([]string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
+
+// flags returns the flag set of the command being run.
+func (c *cli) flags() *flag.FlagSet {
+	cmd := c.command
+	flags := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	flags.SetOutput(c.stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(c.stderr, "Usage: upload [global flags] %s [flags] %s\n\n%s.\n\n", cmd.name, cmd.args, strings.ToUpper(cmd.short[:1])+cmd.short[1:])
+		flags.PrintDefaults()
 	}
-	defer file.Close()
+	return flags
+}
 
-	reader := csv.NewReader(file)
-	records, err := reader.ReadAll()
+// parse parses the flags of a command and checks it got between min and max
+// arguments; max < 0 means no limit.
+func parse(flags *flag.FlagSet, args []string, min int, max int) error {
+	err := flags.Parse(args)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{msg: err.Error()}
 	}
-
-	var fileIds []string
-	for _, record := range records[1:] { // Skip header
-		fileIds = append(fileIds, record[0])
+	n := flags.NArg()
+	if n < min || (max >= 0 && n > max) {
+		flags.Usage()
+		return usagef("%s: wrong number of arguments", flags.Name())
 	}
-
-	return fileIds, nil
+	return nil
 }
 
-func CheckFile() {
-	// Read the CSV file and print the file IDs
-	fileIds, err := ReadCSVFile("/Users/ogandar/Desktop/upload_folder/mount/output/zTknw.csv")
-	if err != nil {
-		log.Panic(err)
+// fail reports err, if any, and returns the exit code for it.
+func (c *cli) fail(err error) int {
+	if err == nil {
+		return exitOK
 	}
-
-	var wg sync.WaitGroup
-	sem := make(chan struct{}, 5)
-
-	for _, fileId := range fileIds {
-		wg.Add(1)
-		sem <- struct{}{}
-		go func(fileId string) {
-			defer func() { <-sem }()
-			GetDoFile(fileId, &wg)
-		}(fileId)
+	code := exitCode(err)
+	// Error bodies quoted in API errors often end with a newline.
+	msg := strings.TrimSpace(err.Error())
+	if c.json {
+		c.printJSON(c.stderr, map[string]interface{}{"error": msg, "exitCode": code})
+	} else {
+		fmt.Fprintf(c.stderr, "upload: %s\n", msg)
 	}
-	wg.Wait()
+	return code
+}
 
+func exitCode(err error) int {
+	var usageErr *usageError
+	var uploadErr *shared.UploadError
+	var downloadErr *shared.DownloadError
+	var partErr *shared.PartError
+	switch {
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.Is(err, shared.ErrUnauthorized):
+		return exitAuth
+	case errors.Is(err, shared.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, shared.ErrPollTimeout), errors.Is(err, context.DeadlineExceeded):
+		return exitTimeout
+	case errors.Is(err, shared.ErrProcessingFailed):
+		return exitProcessing
+	case errors.Is(err, shared.ErrChecksumMismatch), errors.Is(err, errNotInRegion):
+		return exitVerify
+	case errors.As(err, &uploadErr), errors.As(err, &downloadErr), errors.As(err, &partErr):
+		return exitTransfer
+	}
+	return exitFailure
 }
 
-func CreateFileToCSV(numberFiles int, filePath string, singlePart bool) {
+// print writes v as JSON with -json and text otherwise.
+func (c *cli) print(v interface{}, text string) {
+	if c.json {
+		c.printJSON(c.stdout, v)
+		return
+	}
+	fmt.Fprintln(c.stdout, strings.TrimSuffix(text, "\n"))
+}
 
-	name := shared.GenerateRandomString(5)
+func (c *cli) printJSON(w io.Writer, v interface{}) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
 
-	csvFile, err := os.Create(fmt.Sprintf("/Users/ogandar/Desktop/upload_folder/mount/output/%s.csv", name))
+func (c *cli) environment() (shared.Environment, error) {
+	env, err := shared.LoadEnvironment(c.config, c.profile)
 	if err != nil {
-		log.Panic(err)
+		return shared.Environment{}, err
 	}
-	defer csvFile.Close()
-
-	writer := csv.NewWriter(csvFile)
-	defer writer.Flush()
+	if env.Scope == "" {
+		env.Scope = defaultScope
+	}
+	if c.clientID != "" {
+		env.ClientID = c.clientID
+	}
+	return env, nil
+}
 
-	err = writer.Write([]string{"file_id"})
+// service returns the client of the backend selected with -backend.
+func (c *cli) service() (shared.Service, error) {
+	env, err := c.environment()
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
-	var wg sync.WaitGroup
-	//var mutex sync.Mutex
-
-	sem := make(chan struct{}, 40)
-	if !singlePart {
-		sem = make(chan struct{}, 5)
+	if env.ClientID == "" {
+		return nil, usagef("no OAuth client: set -client-id, $%s or the clientId of the environment", shared.EnvClientID)
 	}
-	parentId := "5de170a9-ebb5-42d8-87c1-35bc0594c914"
-	for i := 0; i < numberFiles; i++ {
-		sem <- struct{}{}
-		go func() {
-			defer func() { <-sem }()
-			parentId = CreateFSFolder(parentId)
-			CreateFSFile(parentId)
-			//WriteToCSV(&wg, fileId, writer, &mutex)
-		}()
+	if c.clientSecret == "" {
+		return nil, usagef("no OAuth client secret: set -client-secret or $%s", envClientSecret)
 	}
-	wg.Wait()
-	fmt.Printf("File created: %s\n", name)
+	creds := env.Credentials(env.ClientID, c.clientSecret)
+	switch c.backend {
+	case dataocean.ServiceName:
+		return dataocean.NewDataOcean(env, creds), nil
+	case fileservice.ServiceName:
+		if c.spaceId == "" {
+			return nil, usagef("fileservice needs -space-id or $%s", envSpaceID)
+		}
+		fs := fileservice.NewFileService(env, creds)
+		fs.CacheSpace(c.spaceId)
+		return fs, nil
+	}
+	return nil, usagef("unknown backend %q, want dataocean or fileservice", c.backend)
 }
 
-func main() {
-	CreateFSFile("5de170a9-ebb5-42d8-87c1-35bc0594c914")
-	//CreateDOFile("/Users/ogandar/Desktop/upload_folder/mount/input/VSCode-darwin-universal.zip", false)
-	//CreateFileToCSV(1000, "/Users/ogandar/Desktop/upload_folder/mount/input/route53.zip", true)
-	//CreateDOFile(100, "/Users/ogandar/Desktop/upload_folder/mount/input/route53.zip", true)
-	//CheckFile()
-
+// options returns the upload and download options set by the global flags.
+func (c *cli) options() shared.UploadOptions {
+	return shared.UploadOptions{
+		MaxRoutines: c.concurrency,
+		ChunkSize:   int64(c.chunkSize),
+	}
 }
 
-/*
-func main() {
-
-
-	if len(os.Args) < 4 {
-		log.Fatalf("Usage: %s <numberFiles> <filePath> <singlePart>", os.Args[0])
+// progress returns the reporter for the -progress flag of upload and
+// download: a bar on stderr, or JSON events with -json.
+func (c *cli) progress() shared.ProgressReporter {
+	if c.json {
+		return &shared.JSONProgress{Out: c.stderr}
 	}
+	return shared.NewProgressBar(c.stderr)
+}
 
-	numberFiles, err := strconv.Atoi(os.Args[1])
-	if err != nil {
-		log.Fatalf("Invalid numberFiles: %v", err)
+func envOr(name string, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
 	}
+	return fallback
+}
 
-	filePath := os.Args[2]
-	singlePart, err := strconv.ParseBool(os.Args[3])
-	if err != nil {
-		log.Fatalf("Invalid singlePart: %v", err)
-	}
+// byteSize is a flag.Value for sizes such as 8MiB, 5MB or 1048576. K, M and G
+// and KiB, MiB and GiB are powers of 1024; KB, MB and GB are powers of 1000.
+type byteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+	{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30},
+	{"B", 1},
+}
 
-	CreateFileToCSV(numberFiles, filePath, singlePart)
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
 
+func (b *byteSize) Set(s string) error {
+	unit := int64(1)
+	number := s
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(s), strings.ToUpper(u.suffix)) {
+			unit = u.size
+			number = strings.TrimSpace(s[:len(s)-len(u.suffix)])
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64/unit {
+		return fmt.Errorf("size %q is too large", s)
+	}
+	*b = byteSize(n * unit)
+	return nil
 }
-*/
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/dataocean/dataoceantest"
+	"github.com/osga1291/upload/fileservice"
+	"github.com/osga1291/upload/fileservice/fileservicetest"
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+// useServer points the environment variables read by run at a fake server
+// accepting clientID and clientSecret, and clears every other UPLOAD_*
+// variable for the duration of t.
+func useServer(t *testing.T, url string, clientID string, clientSecret string) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, "UPLOAD_") {
+			t.Setenv(key, "")
+		}
+	}
+	t.Setenv("UPLOAD_DATAOCEAN_URL", url)
+	t.Setenv("UPLOAD_FILESERVICE_URL", url)
+	t.Setenv(shared.EnvTokenURL, url+sharedtest.TokenPath)
+	t.Setenv(shared.EnvClientID, clientID)
+	t.Setenv(envClientSecret, clientSecret)
+}
+
+func newDataOcean(t *testing.T) *dataoceantest.Server {
+	server := dataoceantest.NewServer()
+	t.Cleanup(server.Close)
+	server.PendingPolls = 0
+	useServer(t, server.URL, dataoceantest.ClientID, dataoceantest.ClientSecret)
+	return server
+}
+
+func newFileService(t *testing.T) (*fileservicetest.Server, string) {
+	server := fileservicetest.NewServer()
+	t.Cleanup(server.Close)
+	server.PendingPolls = 0
+	useServer(t, server.URL, fileservicetest.ClientID, fileservicetest.ClientSecret)
+	spaceId := server.CreateSpace("test")
+	t.Setenv(envSpaceID, spaceId)
+	return server, spaceId
+}
+
+// runCLI runs the command line args and returns its exit code, stdout and
+// stderr.
+func runCLI(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// runJSON runs args with -json, expects it to succeed and decodes its stdout
+// into v.
+func runJSON(t *testing.T, v interface{}, args ...string) {
+	t.Helper()
+	code, stdout, stderr := runCLI(append([]string{"-json"}, args...)...)
+	if code != exitOK {
+		t.Fatalf("%s: exit code %d: %s", strings.Join(args, " "), code, stderr)
+	}
+	err := json.Unmarshal([]byte(stdout), v)
+	if err != nil {
+		t.Fatalf("%s: stdout is not JSON: %v\n%s", strings.Join(args, " "), err, stdout)
+	}
+}
+
+func TestRunDataOcean(t *testing.T) {
+	server := newDataOcean(t)
+	file, content := sharedtest.TempFile(t, 64*1024)
+
+	var uploaded uploadResult
+	runJSON(t, &uploaded, "-backend", "dataocean", "upload", "-path", "/cli/source", "-regions", "eu1", file.Name())
+	if got, ok := server.Content(uploaded.FileID); !ok || !bytes.Equal(got, content) {
+		t.Fatalf("content of %s differs from the uploaded file", uploaded.FileID)
+	}
+	if uploaded.Bytes != int64(len(content)) {
+		t.Errorf("upload reports %d bytes, want %d", uploaded.Bytes, len(content))
+	}
+
+	var stat dataocean.File
+	runJSON(t, &stat, "-backend", "dataocean", "stat", uploaded.FileID)
+	if stat.ID != uploaded.FileID || stat.Path != "/cli/source" || stat.SHA256 != sharedtest.SHA256(content) {
+		t.Errorf("stat returned %+v", stat)
+	}
+
+	dst := filepath.Join(t.TempDir(), "download")
+	var downloaded downloadResult
+	runJSON(t, &downloaded, "-backend", "dataocean", "download", "-verify", uploaded.FileID, dst)
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) || downloaded.Path != dst || downloaded.Bytes != int64(len(content)) {
+		t.Errorf("download returned %+v and %d bytes", downloaded, len(got))
+	}
+}
+
+func TestRunFileService(t *testing.T) {
+	server, spaceId := newFileService(t)
+	file, content := sharedtest.TempFile(t, 64*1024)
+
+	code, stdout, stderr := runCLI("upload", "-name", "source.bin", file.Name())
+	if code != exitOK {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	fileId := strings.TrimSpace(stdout)
+	if got, ok := server.Content(fileId); !ok || !bytes.Equal(got, content) {
+		t.Fatalf("content of %s differs from the uploaded file", fileId)
+	}
+
+	var stat fileservice.File
+	runJSON(t, &stat, "stat", fileId)
+	if stat.ID != fileId || stat.Name != "source.bin" || stat.ParentID != spaceId {
+		t.Errorf("stat returned %+v", stat)
+	}
+
+	dst := filepath.Join(t.TempDir(), "download")
+	code, stdout, stderr = runCLI("download", fileId, dst)
+	if code != exitOK || strings.TrimSpace(stdout) != dst {
+		t.Fatalf("exit code %d, stdout %q: %s", code, stdout, stderr)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("downloaded %d bytes, %v; want the uploaded file", len(got), err)
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	newDataOcean(t)
+	csv := filepath.Join(t.TempDir(), "ids.csv")
+	err := os.WriteFile(csv, []byte("file_id\nmissing\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"help", []string{"help"}, exitOK},
+		{"no command", nil, exitUsage},
+		{"unknown command", []string{"nope"}, exitUsage},
+		{"unknown global flag", []string{"-nope", "stat", "x"}, exitUsage},
+		{"unknown command flag", []string{"-backend", "dataocean", "stat", "-nope", "x"}, exitUsage},
+		{"missing argument", []string{"-backend", "dataocean", "stat"}, exitUsage},
+		{"unknown backend", []string{"-backend", "s3", "stat", "x"}, exitUsage},
+		{"fileservice without a space", []string{"stat", "x"}, exitUsage},
+		{"wrong client secret", []string{"-backend", "dataocean", "-client-secret", "wrong", "stat", "x"}, exitAuth},
+		{"wrong client id", []string{"-backend", "dataocean", "-client-id", "wrong", "stat", "x"}, exitAuth},
+		{"unknown file", []string{"-backend", "dataocean", "stat", "missing"}, exitNotFound},
+		{"unknown file to verify", []string{"-backend", "dataocean", "verify-regions", csv}, exitNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, _, stderr := runCLI(test.args...)
+			if code != test.want {
+				t.Errorf("exit code %d, want %d: %s", code, test.want, stderr)
+			}
+		})
+	}
+
+	// Without a client id or secret no request is made.
+	t.Setenv(envClientSecret, "")
+	code, _, stderr := runCLI("-backend", "dataocean", "stat", "x")
+	if code != exitUsage || !strings.Contains(stderr, "no OAuth client secret") {
+		t.Errorf("without a client secret: exit code %d: %s", code, stderr)
+	}
+	t.Setenv(shared.EnvClientID, "")
+	code, _, stderr = runCLI("-backend", "dataocean", "-client-secret", "x", "stat", "x")
+	if code != exitUsage || !strings.Contains(stderr, "no OAuth client:") {
+		t.Errorf("without a client id: exit code %d: %s", code, stderr)
+	}
+}
+
+func TestRunVerifyRegions(t *testing.T) {
+	newDataOcean(t)
+	file, _ := sharedtest.TempFile(t, 1024)
+	var uploaded uploadResult
+	runJSON(t, &uploaded, "-backend", "dataocean", "upload", "-regions", "eu1,us1", file.Name())
+	csv := filepath.Join(t.TempDir(), "ids.csv")
+	err := os.WriteFile(csv, []byte("file_id,seconds\n"+uploaded.FileID+",0.1\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, stdout, stderr := runCLI("-backend", "dataocean", "verify-regions", "-region", "us1", csv)
+	if code != exitOK || !strings.Contains(stdout, "1 of 1 files in us1") {
+		t.Errorf("exit code %d, stdout %q: %s", code, stdout, stderr)
+	}
+
+	code, stdout, stderr = runCLI("-backend", "dataocean", "-json", "verify-regions", "-region", "ap1", csv)
+	if code != exitVerify {
+		t.Fatalf("exit code %d, want %d: %s", code, exitVerify, stderr)
+	}
+	var result struct {
+		Region string        `json:"region"`
+		Files  []regionCheck `json:"files"`
+	}
+	err = json.Unmarshal([]byte(stdout), &result)
+	if err != nil {
+		t.Fatalf("stdout is not JSON: %v\n%s", err, stdout)
+	}
+	want := []regionCheck{{FileID: uploaded.FileID, Regions: []string{"eu1", "us1"}}}
+	if result.Region != "ap1" || !reflect.DeepEqual(result.Files, want) {
+		t.Errorf("got %+v, want the file reported missing from ap1", result)
+	}
+}
+
+func TestRunDownloadFails(t *testing.T) {
+	server := newDataOcean(t)
+	file, _ := sharedtest.TempFile(t, 1024)
+	var uploaded uploadResult
+	runJSON(t, &uploaded, "-backend", "dataocean", "upload", file.Name())
+	// The file is still listed but its content is gone, so every ranged GET
+	// of the download fails.
+	server.Blobs.Delete(uploaded.FileID)
+
+	dst := filepath.Join(t.TempDir(), "download")
+	code, _, stderr := runCLI("-backend", "dataocean", "download", uploaded.FileID, dst)
+	if code != exitTransfer || !strings.Contains(stderr, "parts failed") {
+		t.Errorf("exit code %d, want %d: %s", code, exitTransfer, stderr)
+	}
+}
+
+func TestRunErrorOutput(t *testing.T) {
+	newDataOcean(t)
+
+	code, stdout, stderr := runCLI("-backend", "dataocean", "stat", "missing")
+	if code != exitNotFound || stdout != "" || !strings.HasPrefix(stderr, "upload: ") || strings.Count(stderr, "\n") != 1 {
+		t.Errorf("exit code %d, stdout %q, stderr %q", code, stdout, stderr)
+	}
+
+	code, stdout, stderr = runCLI("-backend", "dataocean", "-json", "stat", "missing")
+	var got struct {
+		Error    string `json:"error"`
+		ExitCode int    `json:"exitCode"`
+	}
+	err := json.Unmarshal([]byte(stderr), &got)
+	if err != nil {
+		t.Fatalf("stderr is not JSON: %v\n%s", err, stderr)
+	}
+	if code != exitNotFound || stdout != "" || got.ExitCode != exitNotFound || !strings.Contains(got.Error, "missing") {
+		t.Errorf("exit code %d, stdout %q, stderr %+v", code, stdout, got)
+	}
+}
+
+func TestByteSizeSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		// err is part of the expected error message; empty means none.
+		err string
+	}{
+		{"0", 0, ""},
+		{"1048576", 1048576, ""},
+		{"10B", 10, ""},
+		{"8K", 8 << 10, ""},
+		{"8KiB", 8 << 10, ""},
+		{"8KB", 8000, ""},
+		{"5M", 5 << 20, ""},
+		{"5MiB", 5 << 20, ""},
+		{"5mib", 5 << 20, ""},
+		{"5MB", 5 * 1000 * 1000, ""},
+		{"5 MB", 5 * 1000 * 1000, ""},
+		{"2G", 2 << 30, ""},
+		{"2GiB", 2 << 30, ""},
+		{"2GB", 2 * 1000 * 1000 * 1000, ""},
+		{"9223372036854775807", math.MaxInt64, ""},
+		{"8589934591GiB", 8589934591 << 30, ""},
+		{"8589934592GiB", 0, "too large"},
+		{"9223372036854775807K", 0, "too large"},
+		{"9223372036854775808", 0, "invalid size"},
+		{"", 0, "invalid size"},
+		{"MiB", 0, "invalid size"},
+		{"-1MiB", 0, "invalid size"},
+		{"1.5MiB", 0, "invalid size"},
+		{"5TB", 0, "invalid size"},
+	}
+	for _, test := range tests {
+		var b byteSize
+		err := b.Set(test.value)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Set(%q) = %v, want an error with %q", test.value, err, test.err)
+			}
+			continue
+		}
+		if err != nil || int64(b) != test.want {
+			t.Errorf("Set(%q) = %d, %v, want %d", test.value, b, err, test.want)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	values := []float64{5, 1, 4, 2, 3}
+	tests := []struct {
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 0.5, 0},
+		{[]float64{7}, 0.95, 7},
+		{values, 0, 1},
+		{values, 0.5, 3},
+		{values, 0.95, 4},
+		{values, 1, 5},
+	}
+	for _, test := range tests {
+		if got := percentile(test.values, test.p); got != test.want {
+			t.Errorf("percentile(%v, %v) = %v, want %v", test.values, test.p, got, test.want)
+		}
+	}
+	if !reflect.DeepEqual(values, []float64{5, 1, 4, 2, 3}) {
+		t.Errorf("percentile sorted its argument: %v", values)
+	}
+}
+
+func TestReadFileIds(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{"loadtest CSV", "file_id,seconds,error\na,1.0,\n,2.0,failed\nb,3.0,\n", []string{"a", "b"}},
+		{"no header", "a\nb\n", []string{"a", "b"}},
+		{"ragged rows", "a,x,y\nb\nc,z\n", []string{"a", "b", "c"}},
+		{"file_id after the header", "a\nfile_id\n", []string{"a", "file_id"}},
+		{"empty", "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ids.csv")
+			err := os.WriteFile(path, []byte(test.content), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := readFileIds(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	_, err := readFileIds(filepath.Join(t.TempDir(), "missing.csv"))
+	if !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v", err)
+	}
+}
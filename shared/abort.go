@@ -0,0 +1,112 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// abortTimeout bounds the cleanup of a failed upload, which runs even when the
+// context of the upload itself was cancelled.
+const abortTimeout = 30 * time.Second
+
+// Aborter is implemented by services that can delete the server side state of
+// an upload that will not be completed.
+type Aborter interface {
+	Abort(id string) error
+	AbortContext(ctx context.Context, id string) error
+}
+
+// abortUpload aborts the upload id after it failed with err, if service
+// supports it, and returns err together with any error from the abort. An
+// UploadError in err is marked Aborted when the abort succeeds.
+func abortUpload(service Service, id string, err error) error {
+	aborter, ok := service.(Aborter)
+	if !ok {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	abortErr := aborter.AbortContext(ctx, id)
+	var uploadErr *UploadError
+	if errors.As(err, &uploadErr) {
+		uploadErr.Aborted = abortErr == nil
+	}
+	if abortErr != nil {
+		return errors.Join(err, fmt.Errorf("abort upload %s: %w", id, abortErr))
+	}
+	return err
+}
+
+// resumable reports whether an upload that failed with err can still be
+// finished from its journal.
+func resumable(j *Journal, err error) bool {
+	if j.path == "" {
+		return false
+	}
+	var uploadErr *UploadError
+	return errors.As(err, &uploadErr) || isContextError(err)
+}
+
+// ListJournals returns the journals stored in stateDir.
+func ListJournals(stateDir string) ([]*Journal, error) {
+	entries, err := os.ReadDir(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	var journals []*Journal
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".upload.json") {
+			continue
+		}
+		j, err := LoadJournal(filepath.Join(stateDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		journals = append(journals, j)
+	}
+	return journals, nil
+}
+
+// Stale reports whether the upload can no longer be resumed or has not made
+// progress for longer than olderThan.
+func (j *Journal) Stale(olderThan time.Duration) bool {
+	return j.Expired() || time.Since(j.UpdatedAt) > olderThan
+}
+
+// SweepUploads aborts the uploads recorded in journals and removes the
+// journals. Journals of uploads started on another service are left alone and
+// reported with ErrJournalMismatch; an upload that service no longer knows is
+// already gone and its journal is removed. It carries on past failures and
+// returns them joined.
+func SweepUploads(ctx context.Context, service Service, journals []*Journal) error {
+	aborter, ok := service.(Aborter)
+	if !ok {
+		return fmt.Errorf("service does not support aborting uploads")
+	}
+	var errs []error
+	for _, j := range journals {
+		err := j.checkService(service)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		err = aborter.AbortContext(ctx, j.ID)
+		if errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("abort upload %s: %w", j.ID, err))
+			continue
+		}
+		err = j.Remove()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,101 @@
+package shared_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/dataocean/dataoceantest"
+	"github.com/osga1291/upload/fileservice"
+	"github.com/osga1291/upload/fileservice/fileservicetest"
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+func TestJournalStale(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		updatedAt time.Time
+		expiresAt time.Time
+		want      bool
+	}{
+		{"recent", now.Add(-time.Minute), time.Time{}, false},
+		{"recent and not expired", now.Add(-time.Minute), now.Add(time.Hour), false},
+		{"no progress for too long", now.Add(-2 * time.Hour), time.Time{}, true},
+		{"no progress for too long and not expired", now.Add(-2 * time.Hour), now.Add(time.Hour), true},
+		{"recent but expired", now.Add(-time.Minute), now.Add(-time.Second), true},
+	}
+	for _, test := range tests {
+		j := &shared.Journal{UpdatedAt: test.updatedAt, ExpiresAt: test.expiresAt}
+		if got := j.Stale(time.Hour); got != test.want {
+			t.Errorf("%s: Stale = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSweepUploads(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	ft := sharedtest.Install(do.GetClient())
+	file, _ := sharedtest.TempFile(t, fileSize)
+	payload := func() shared.Payload { return dataocean.NewFileRequest("/sweep/file.bin").Multipart() }
+
+	stale := interrupt(t, do, ft, payload(), nil, file)
+	ft.Clear()
+	gone := interrupt(t, do, ft, payload(), nil, file)
+
+	// Uploads of another DataOcean and of FileService, whose ids the
+	// service being swept does not know.
+	other := dataoceantest.NewServer()
+	defer other.Close()
+	otherDo := other.Client()
+	foreign := interrupt(t, otherDo, sharedtest.Install(otherDo.GetClient()), payload(), nil, file)
+	fsServer := fileservicetest.NewServer()
+	defer fsServer.Close()
+	spaceId := fsServer.CreateSpace("sweep")
+	fs := fsServer.Client(spaceId)
+	fsJournal := interrupt(t, fs, sharedtest.Install(fs.GetClient()), fileservice.NewUploadRequest("file.bin", spaceId).Multipart(), nil, file)
+
+	var journals []*shared.Journal
+	for _, path := range []string{stale, gone, foreign, fsJournal} {
+		j, err := shared.LoadJournal(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		journals = append(journals, j)
+	}
+	// The upload of gone was already aborted.
+	err := do.AbortContext(context.Background(), journals[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = shared.SweepUploads(context.Background(), do, journals)
+	if !errors.Is(err, shared.ErrJournalMismatch) {
+		t.Fatalf("got %v, want ErrJournalMismatch for the journals of other services", err)
+	}
+	for _, path := range []string{stale, gone} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("journal %s not removed: %v", path, err)
+		}
+	}
+	if _, ok := server.File(journals[0].ID); ok {
+		t.Errorf("stale upload %s not aborted", journals[0].ID)
+	}
+	for _, path := range []string{foreign, fsJournal} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("journal of another service removed: %v", err)
+		}
+	}
+	if _, ok := other.File(journals[2].ID); !ok {
+		t.Errorf("upload of another DataOcean aborted")
+	}
+	if _, _, ok := fsServer.Upload(journals[3].ID); !ok {
+		t.Errorf("FileService upload aborted")
+	}
+}
@@ -0,0 +1,145 @@
+// Package cassette records the HTTP traffic of a Service client into a
+// sanitized file and replays it offline, so a session captured against a
+// real environment can run in CI.
+//
+// A cassette is plugged into the client of a Service:
+//
+//	stop, err := cassette.Install(do.GetClient(), "testdata/upload.json", cassette.ModeReplay)
+//
+// In ModeRecord the requests go to the real endpoints and stop writes the
+// cassette; in ModeReplay every response comes from the cassette and nothing
+// is sent.
+package cassette
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"unicode/utf8"
+)
+
+// ErrNoInteraction is returned in ModeReplay for a request the cassette has
+// no interaction for.
+var ErrNoInteraction = errors.New("no recorded interaction matches the request")
+
+type Mode string
+
+const (
+	ModeRecord Mode = "record"
+	ModeReplay Mode = "replay"
+)
+
+// Cassette is a recorded session.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+
+	mutex sync.Mutex
+	// used marks the interactions already replayed.
+	used []bool
+}
+
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is a recorded request. Only textual bodies are kept; for others,
+// such as the content of upload parts, only BodySize is.
+type Request struct {
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Header   http.Header `json:"header,omitempty"`
+	Body     string      `json:"body,omitempty"`
+	BodySize int64       `json:"bodySize,omitempty"`
+}
+
+// Response is a recorded response. Binary bodies are kept base64 encoded.
+type Response struct {
+	StatusCode   int         `json:"statusCode"`
+	Header       http.Header `json:"header,omitempty"`
+	Body         string      `json:"body,omitempty"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+}
+
+// Load reads the cassette stored at path.
+func Load(path string) (*Cassette, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{}
+	err = json.Unmarshal(b, c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cassette %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Save writes the cassette to path.
+func (c *Cassette) Save(path string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+func (c *Cassette) add(i Interaction) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Interactions = append(c.Interactions, i)
+}
+
+// Install plugs the cassette at path into client. In ModeRecord the returned
+// func saves the cassette, and in ModeReplay it does nothing; either way it
+// puts back the transport client had.
+func Install(client *http.Client, path string, mode Mode) (func() error, error) {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	restore := client.Transport
+
+	switch mode {
+	case ModeRecord:
+		c := &Cassette{}
+		client.Transport = &Recorder{Base: base, Cassette: c}
+		return func() error {
+			client.Transport = restore
+			return c.Save(path)
+		}, nil
+	case ModeReplay:
+		c, err := Load(path)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = &Player{Cassette: c, Matcher: DefaultMatcher}
+		return func() error {
+			client.Transport = restore
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown cassette mode %q", mode)
+}
+
+// encodeBody returns body as a string, base64 encoding it when it is not
+// text.
+func encodeBody(body []byte) (string, string) {
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func decodeBody(body string, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(body)
+	}
+	return []byte(body), nil
+}
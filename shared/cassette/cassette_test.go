@@ -0,0 +1,129 @@
+package cassette_test
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/dataocean/dataoceantest"
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/cassette"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+func upload(t *testing.T, do *dataocean.DataOcean, file *os.File) (string, error) {
+	payload := dataocean.NewFileRequest("/cassette/" + shared.GenerateRandomString(5)).Multipart()
+	return shared.Upload(do, payload, nil, file, shared.UploadOptions{ChunkSize: 5 * 1024 * 1024, MaxRoutines: 2})
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	server := dataoceantest.NewServer()
+	path := filepath.Join(t.TempDir(), "upload.json")
+	file, _ := sharedtest.TempFile(t, 11*1024*1024)
+
+	do := server.Client()
+	stop, err := cassette.Install(do.GetClient(), path, cassette.ModeRecord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordedId, err := upload(t, do, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), dataoceantest.ClientSecret) {
+		t.Errorf("cassette holds the client secret")
+	}
+	if regexp.MustCompile(`signature=[0-9a-f]`).Match(b) {
+		t.Errorf("cassette holds a presigned URL signature")
+	}
+	if regexp.MustCompile(`"access_token\\?":\s*\\?"[0-9a-f]`).Match(b) {
+		t.Errorf("cassette holds an access token")
+	}
+
+	// The server is gone: everything now comes from the cassette, including
+	// the token, while the file gets a new random path.
+	do = server.Client()
+	stop, err = cassette.Install(do.GetClient(), path, cassette.ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	replayedId, err := upload(t, do, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayedId != recordedId {
+		t.Errorf("replayed file %s, recorded %s", replayedId, recordedId)
+	}
+}
+
+func TestReplayUnknownRequest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.json")
+	err := (&cassette.Cassette{}).Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{}
+	_, err = cassette.Install(client, path, cassette.ModeReplay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get("http://example.com/files/1")
+	if !errors.Is(err, cassette.ErrNoInteraction) {
+		t.Fatalf("got %v, want ErrNoInteraction", err)
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	recorded := cassette.Request{
+		Method: "POST",
+		URL:    "https://example.com/files?urlDuration=1h",
+		Body:   `{"file":{"path":"/folderA/x7Kq2","regions":["us1"]}}`,
+	}
+	tests := []struct {
+		name  string
+		url   string
+		body  string
+		match bool
+	}{
+		{"same", "https://example.com/files?urlDuration=1h", `{"file":{"path":"/folderA/x7Kq2","regions":["us1"]}}`, true},
+		{"random name", "https://example.com/files?urlDuration=1h", `{"file":{"regions":["us1"],"path":"/folderA/Pp0aZ"}}`, true},
+		{"other folder", "https://example.com/files?urlDuration=1h", `{"file":{"path":"/folderB/Pp0aZ","regions":["us1"]}}`, false},
+		{"longer name", "https://example.com/files?urlDuration=1h", `{"file":{"path":"/folderA/Pp0aZz","regions":["us1"]}}`, false},
+		{"other region", "https://example.com/files?urlDuration=1h", `{"file":{"path":"/folderA/x7Kq2","regions":["eu1"]}}`, false},
+		{"other query", "https://example.com/files?urlDuration=2h", `{"file":{"path":"/folderA/x7Kq2","regions":["us1"]}}`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if got := cassette.DefaultMatcher.Match(recorded, req, []byte(test.body)); got != test.match {
+				t.Errorf("Match = %v, want %v", got, test.match)
+			}
+		})
+	}
+
+	part := cassette.Request{Method: "PUT", URL: "https://bucket.example.com/parts/1?signature=REDACTED", BodySize: 4}
+	req, _ := http.NewRequest("PUT", "https://bucket.example.com/parts/1?signature=abc123", nil)
+	if !cassette.DefaultMatcher.Match(part, req, []byte("different content")) {
+		t.Errorf("binary part bodies are compared")
+	}
+}
@@ -0,0 +1,174 @@
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Redacted replaces every secret written to a cassette.
+const Redacted = "REDACTED"
+
+// Secrets that never reach a cassette: headers, query parameters of presigned
+// URLs, and JSON or form fields. Names are compared case-insensitively.
+var (
+	redactedHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Amz-Security-Token"}
+	redactedQuery   = []string{"signature", "sig", "x-amz-signature", "x-amz-credential", "x-amz-security-token", "key-pair-id", "policy", "token", "access_token"}
+	redactedFields  = []string{"access_token", "refresh_token", "id_token", "client_secret", "password"}
+)
+
+// Recorder is an http.RoundTripper that sends requests with Base and records
+// a sanitized copy of every exchange in Cassette.
+type Recorder struct {
+	Base     http.RoundTripper
+	Cassette *Cassette
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorded := Request{
+		Method: req.Method,
+		URL:    redactURL(req.URL.String()),
+		Header: redactHeader(req.Header),
+	}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		recorded.BodySize = int64(len(body))
+		if isText(req.Header.Get("Content-Type")) {
+			recorded.Body = string(redactBody(body))
+		}
+	}
+
+	resp, err := r.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	response := Response{StatusCode: resp.StatusCode, Header: redactHeader(resp.Header)}
+	if isText(resp.Header.Get("Content-Type")) {
+		body = redactBody(body)
+	}
+	response.Body, response.BodyEncoding = encodeBody(body)
+	r.Cassette.add(Interaction{Request: recorded, Response: response})
+	return resp, nil
+}
+
+// isText reports whether a body of contentType is recorded as text. Bodies
+// without a content type, such as upload parts, are not.
+func isText(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || mediaType == "application/json" || mediaType == "application/x-www-form-urlencoded"
+}
+
+func redactHeader(header http.Header) http.Header {
+	clone := header.Clone()
+	for _, name := range redactedHeaders {
+		if clone.Get(name) != "" {
+			clone.Set(name, Redacted)
+		}
+	}
+	return clone
+}
+
+// redactURL replaces the secret query parameters of a URL, such as the
+// signature of a presigned URL.
+func redactURL(raw string) string {
+	// The URL is not rebuilt from its parsed form, which would escape the
+	// "*" standing for the part number in multipart upload URLs.
+	base, query, ok := strings.Cut(raw, "?")
+	if !ok {
+		return raw
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return raw
+	}
+	changed := false
+	for key := range q {
+		if contains(redactedQuery, key) {
+			q.Set(key, Redacted)
+			changed = true
+		}
+	}
+	if !changed {
+		return raw
+	}
+	return base + "?" + q.Encode()
+}
+
+// redactBody redacts the secret fields of a JSON or form body, and the URLs
+// found in the strings of a JSON body.
+func redactBody(body []byte) []byte {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if decoder.Decode(&v) == nil {
+		b, err := json.Marshal(redactJSON(v))
+		if err == nil {
+			return b
+		}
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil || len(form) == 0 {
+		return body
+	}
+	changed := false
+	for key := range form {
+		if contains(redactedFields, key) {
+			form.Set(key, Redacted)
+			changed = true
+		}
+	}
+	if !changed {
+		return body
+	}
+	return []byte(form.Encode())
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if contains(redactedFields, key) {
+				v[key] = Redacted
+			} else {
+				v[key] = redactJSON(value)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactJSON(v[i])
+		}
+	case string:
+		if strings.HasPrefix(v, "http://") || strings.HasPrefix(v, "https://") {
+			return redactURL(v)
+		}
+	}
+	return v
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+// Matcher decides which recorded request a new request replays. Method, URL
+// and query must be equal once secrets are redacted, and textual bodies must
+// hold the same JSON or text. Bodies recorded only by size, such as upload
+// parts, are not compared.
+type Matcher struct {
+	// RandomFields are the JSON fields whose values may differ in the runs of
+	// letters and digits that shared.GenerateRandomString produces, such as
+	// "/folderA/x7Kq2" against "/folderA/Pp0aZ".
+	RandomFields []string
+	// RandomLength is the length of those runs. 0 lets runs of any length
+	// differ, as long as both have the same length.
+	RandomLength int
+}
+
+var DefaultMatcher = Matcher{RandomFields: []string{"name", "path"}, RandomLength: 5}
+
+// Match reports whether req, whose body is body, replays recorded.
+func (m Matcher) Match(recorded Request, req *http.Request, body []byte) bool {
+	if recorded.Method != req.Method || !sameURL(recorded.URL, redactURL(req.URL.String())) {
+		return false
+	}
+	if recorded.Body == "" {
+		return recorded.BodySize == int64(len(body)) || !isText(req.Header.Get("Content-Type"))
+	}
+	body = redactBody(body)
+	var want, got interface{}
+	if json.Unmarshal([]byte(recorded.Body), &want) != nil || json.Unmarshal(body, &got) != nil {
+		return recorded.Body == string(body)
+	}
+	return m.sameJSON(want, got, "")
+}
+
+func sameURL(recorded string, actual string) bool {
+	a, err := url.Parse(recorded)
+	if err != nil {
+		return recorded == actual
+	}
+	b, err := url.Parse(actual)
+	if err != nil {
+		return false
+	}
+	return a.Scheme == b.Scheme && a.Host == b.Host && a.Path == b.Path && reflect.DeepEqual(a.Query(), b.Query())
+}
+
+func (m Matcher) sameJSON(want interface{}, got interface{}, key string) bool {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for k, v := range w {
+			if !m.sameJSON(v, g[k], k) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !m.sameJSON(w[i], g[i], key) {
+				return false
+			}
+		}
+		return true
+	case string:
+		g, ok := got.(string)
+		if !ok {
+			return false
+		}
+		if contains(m.RandomFields, key) {
+			return m.sameShape(w, g)
+		}
+		return w == g
+	}
+	return reflect.DeepEqual(want, got)
+}
+
+// sameShape reports whether a and b only differ in runs of letters and
+// digits of the same length, and of RandomLength if it is set.
+func (m Matcher) sameShape(a string, b string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); {
+		if !isAlphanumeric(a[i]) || !isAlphanumeric(b[i]) {
+			if a[i] != b[i] {
+				return false
+			}
+			i++
+			continue
+		}
+		end := i
+		for end < len(a) && isAlphanumeric(a[end]) && isAlphanumeric(b[end]) {
+			end++
+		}
+		// Both runs must end at the same place.
+		if end < len(a) && (isAlphanumeric(a[end]) || isAlphanumeric(b[end])) {
+			return false
+		}
+		if a[i:end] != b[i:end] && m.RandomLength > 0 && end-i != m.RandomLength {
+			return false
+		}
+		i = end
+	}
+	return true
+}
+
+func isAlphanumeric(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// Player is an http.RoundTripper that answers requests from Cassette without
+// sending them. Each interaction is replayed once, in recorded order among
+// those matching; once every match was replayed the last one is repeated, so
+// a client polling more often than when it was recorded still gets answers.
+type Player struct {
+	Cassette *Cassette
+	Matcher  Matcher
+}
+
+func (p *Player) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := p.Cassette
+	c.mutex.Lock()
+	if len(c.used) != len(c.Interactions) {
+		c.used = make([]bool, len(c.Interactions))
+	}
+	found := -1
+	for i, interaction := range c.Interactions {
+		if !p.Matcher.Match(interaction.Request, req, body) {
+			continue
+		}
+		found = i
+		if !c.used[i] {
+			break
+		}
+	}
+	if found >= 0 {
+		c.used[found] = true
+	}
+	c.mutex.Unlock()
+	if found < 0 {
+		return nil, fmt.Errorf("%w: %s %s", ErrNoInteraction, req.Method, redactURL(req.URL.String()))
+	}
+
+	recorded := c.Interactions[found].Response
+	content, err := decodeBody(recorded.Body, recorded.BodyEncoding)
+	if err != nil {
+		return nil, err
+	}
+	header := recorded.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode:    recorded.StatusCode,
+		Status:        fmt.Sprintf("%d %s", recorded.StatusCode, http.StatusText(recorded.StatusCode)),
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(content)),
+		ContentLength: int64(len(content)),
+		Request:       req,
+	}, nil
+}
+
+// Unused returns the interactions that were never replayed, as
+// "METHOD URL" lines.
+func (c *Cassette) Unused() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var unused []string
+	for i, interaction := range c.Interactions {
+		if i >= len(c.used) || !c.used[i] {
+			unused = append(unused, strings.TrimSpace(interaction.Request.Method+" "+interaction.Request.URL))
+		}
+	}
+	return unused
+}
@@ -0,0 +1,169 @@
+package shared
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ErrChecksumMismatch is matched by every ChecksumError.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ChecksumAlgorithm selects the checksum sent with every uploaded part.
+type ChecksumAlgorithm string
+
+const (
+	ChecksumNone   ChecksumAlgorithm = ""
+	ChecksumMD5    ChecksumAlgorithm = "md5"
+	ChecksumSHA256 ChecksumAlgorithm = "sha256"
+	ChecksumCRC32C ChecksumAlgorithm = "crc32c"
+)
+
+// ETagVerifier is implemented by services whose part ETags are the hex MD5 of
+// the part, which lets ChecksumMD5 uploads compare them with what was sent.
+type ETagVerifier interface {
+	MD5ETags() bool
+}
+
+// ChecksumVerifier is implemented by services that store the SHA-256 set with
+// Payload.SetChecksum and report it back once the file is available.
+type ChecksumVerifier interface {
+	FileChecksum(ctx context.Context, fileId string) (string, error)
+}
+
+// ChecksumError reports content that does not match its checksum. PartNumber
+// is 0 when the whole file is affected.
+type ChecksumError struct {
+	PartNumber int
+	Algorithm  ChecksumAlgorithm
+	Expected   string
+	Actual     string
+}
+
+func (e *ChecksumError) Error() string {
+	if e.PartNumber == 0 {
+		return fmt.Sprintf("file %s checksum mismatch: local %s, stored %s", e.Algorithm, e.Expected, e.Actual)
+	}
+	return fmt.Sprintf("part %d %s checksum mismatch: sent %s, got %s", e.PartNumber, e.Algorithm, e.Expected, e.Actual)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksumMismatch
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// partChecksum returns the header carrying the checksum of the content of r
+// and, for MD5, the hex digest an MD5 ETag is expected to equal. r is only read
+// when a checksum is needed.
+func partChecksum(algorithm ChecksumAlgorithm, r io.Reader) (http.Header, string, error) {
+	var h hash.Hash
+	var name string
+	switch algorithm {
+	case ChecksumNone:
+		return nil, "", nil
+	case ChecksumMD5:
+		h, name = md5.New(), "Content-MD5"
+	case ChecksumSHA256:
+		h, name = sha256.New(), "x-amz-checksum-sha256"
+	case ChecksumCRC32C:
+		h, name = crc32.New(crc32c), "x-amz-checksum-crc32c"
+	default:
+		return nil, "", fmt.Errorf("unknown checksum algorithm %q", algorithm)
+	}
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := h.Sum(nil)
+	header := http.Header{}
+	header.Set(name, base64.StdEncoding.EncodeToString(sum))
+	if algorithm == ChecksumMD5 {
+		return header, hex.EncodeToString(sum), nil
+	}
+	return header, "", nil
+}
+
+// verifyETag compares the ETag of a part with the MD5 that was sent, when the
+// service uses MD5 ETags. Multipart style ETags ("<md5>-<n>") are not checked.
+func verifyETag(service Service, partNumber int, etag string, md5Hex string) error {
+	verifier, ok := service.(ETagVerifier)
+	if md5Hex == "" || !ok || !verifier.MD5ETags() {
+		return nil
+	}
+	etag = strings.Trim(etag, `"`)
+	if etag == "" || strings.Contains(etag, "-") || strings.EqualFold(etag, md5Hex) {
+		return nil
+	}
+	return &ChecksumError{PartNumber: partNumber, Algorithm: ChecksumMD5, Expected: md5Hex, Actual: etag}
+}
+
+// hashFile returns the hex SHA-256 of the whole file.
+func hashFile(file *os.File) (string, error) {
+	h := sha256.New()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(h, io.NewSectionReader(file, 0, info.Size()))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// attachChecksum hashes file and, if service supports it, records the hash in
+// payload. It returns the hash, or "" when checksums are not verified.
+func attachChecksum(service Service, payload Payload, file *os.File, options UploadOptions) (string, error) {
+	if !options.VerifyChecksum {
+		return "", nil
+	}
+	sum, err := hashFile(file)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := service.(ChecksumVerifier); ok {
+		payload.SetChecksum(sum)
+	}
+	return sum, nil
+}
+
+// verifyChecksum compares the SHA-256 the service stored for fileId with the
+// one computed while uploading. It does nothing when expected is empty or the
+// service cannot report checksums.
+func verifyChecksum(ctx context.Context, service Service, fileId string, expected string) error {
+	verifier, ok := service.(ChecksumVerifier)
+	if expected == "" || !ok {
+		return nil
+	}
+	actual, err := verifier.FileChecksum(ctx, fileId)
+	if err != nil {
+		return err
+	}
+	if actual != "" && !strings.EqualFold(actual, expected) {
+		return &ChecksumError{Algorithm: ChecksumSHA256, Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// hashingSource feeds every chunk produced by next, which must be in part
+// order, into h.
+func hashingSource(next chunkSource, h hash.Hash) chunkSource {
+	return func() (ChunkData, error) {
+		chunk, err := next()
+		if err == nil {
+			h.Write(chunk.Chunk)
+		}
+		return chunk, err
+	}
+}
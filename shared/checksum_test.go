@@ -0,0 +1,131 @@
+package shared_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/dataocean/dataoceantest"
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadETagMismatch(t *testing.T) {
+	const wrongETag = "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name      string
+		size      int
+		multipart bool
+		// pattern is the PUT whose ETag is corrupted, and part its number.
+		pattern string
+		part    int
+		sends   int
+	}{
+		// A part is sent again like any failed part, a single PUT is not.
+		{"multipart", fileSize, true, part2, 2, 3},
+		{"single part", 1024, false, "/blobs/*", 1, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := dataoceantest.NewServer()
+			defer server.Close()
+			do := server.Client()
+			ft := sharedtest.Install(do.GetClient())
+			ft.On("PUT", test.pattern, sharedtest.Fault{Header: http.Header{"Etag": {`"` + wrongETag + `"`}}})
+			ft.On("DELETE", getFile, sharedtest.Fault{})
+			file, content := sharedtest.TempFile(t, test.size)
+			payload := dataocean.NewFileRequest("/checksum/etag.bin")
+			payload.SetMultipart(test.multipart)
+
+			fileId, err := shared.Upload(do, payload, nil, file, shared.UploadOptions{ChunkSize: partSize, Checksum: shared.ChecksumMD5})
+			var checksumErr *shared.ChecksumError
+			if !errors.As(err, &checksumErr) || !errors.Is(err, shared.ErrChecksumMismatch) || fileId != "" {
+				t.Fatalf("got %q, %v, want a ChecksumError", fileId, err)
+			}
+			part := content[(test.part-1)*partSize:]
+			if len(part) > partSize {
+				part = part[:partSize]
+			}
+			want := shared.ChecksumError{
+				PartNumber: test.part,
+				Algorithm:  shared.ChecksumMD5,
+				Expected:   md5Hex(part),
+				Actual:     wrongETag,
+			}
+			if *checksumErr != want {
+				t.Errorf("got %+v, want %+v", *checksumErr, want)
+			}
+			if n := ft.Count("PUT", test.pattern); n != test.sends {
+				t.Errorf("sent %d times, want %d", n, test.sends)
+			}
+			if n := ft.Count("DELETE", getFile); n != 1 {
+				t.Errorf("aborted %d times, want once", n)
+			}
+		})
+	}
+}
+
+func TestUploadStoredChecksumMismatch(t *testing.T) {
+	const stored = "0000000000000000000000000000000000000000000000000000000000000000"
+	tests := []struct {
+		name      string
+		size      int
+		multipart bool
+	}{
+		{"multipart", fileSize, true},
+		{"single part", 1024, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := dataoceantest.NewServer()
+			defer server.Close()
+			do := server.Client()
+			file, content := sharedtest.TempFile(t, test.size)
+			sum := sharedtest.SHA256(content)
+			// The file is stored intact but reported with another SHA-256.
+			ft := sharedtest.NewFaultTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				resp, err := http.DefaultTransport.RoundTrip(req)
+				if err != nil || req.Method != "GET" || !strings.HasPrefix(req.URL.Path, "/files/") {
+					return resp, err
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					return nil, err
+				}
+				body = bytes.ReplaceAll(body, []byte(sum), []byte(stored))
+				resp.Body = io.NopCloser(bytes.NewReader(body))
+				resp.ContentLength = int64(len(body))
+				return resp, nil
+			}))
+			do.GetClient().Transport = ft
+			ft.On("DELETE", getFile, sharedtest.Fault{})
+			payload := dataocean.NewFileRequest("/checksum/stored.bin")
+			payload.SetMultipart(test.multipart)
+
+			fileId, err := shared.Upload(do, payload, nil, file, shared.UploadOptions{ChunkSize: partSize, VerifyChecksum: true})
+			var checksumErr *shared.ChecksumError
+			if !errors.As(err, &checksumErr) || !errors.Is(err, shared.ErrChecksumMismatch) || fileId != "" {
+				t.Fatalf("got %q, %v, want a ChecksumError", fileId, err)
+			}
+			want := shared.ChecksumError{Algorithm: shared.ChecksumSHA256, Expected: sum, Actual: stored}
+			if *checksumErr != want {
+				t.Errorf("got %+v, want %+v", *checksumErr, want)
+			}
+			if n := ft.Count("DELETE", getFile); n != 1 {
+				t.Errorf("aborted %d times, want once", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package shared
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CredentialProvider supplies the bearer token that Request attaches to
+// authorized calls. Each Service carries its own provider so one process can
+// talk to several environments or tenants at once.
+type CredentialProvider interface {
+	// Token returns the current token, fetching one with client if needed.
+	Token(ctx context.Context, client *http.Client) (string, error)
+	// Invalidate discards token if it is still the current one so the next
+	// call to Token fetches a fresh one.
+	Invalidate(token string)
+}
+
+// TokenFetcher fetches a new token and reports how long it is valid for. A
+// zero lifetime means the token does not expire on its own.
+type TokenFetcher func(ctx context.Context, client *http.Client) (string, time.Duration, error)
+
+// DefaultRefreshBefore is how long before expiry a cached token is refreshed.
+const DefaultRefreshBefore = time.Minute
+
+// TokenCache is a CredentialProvider that caches the token returned by Fetch
+// and refreshes it shortly before it expires. Only one goroutine fetches at a
+// time; concurrent callers wait for and share its result.
+type TokenCache struct {
+	Fetch         TokenFetcher
+	RefreshBefore time.Duration
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+	flight  *tokenFlight
+}
+
+type tokenFlight struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+func NewTokenCache(fetch TokenFetcher) *TokenCache {
+	return &TokenCache{
+		Fetch:         fetch,
+		RefreshBefore: DefaultRefreshBefore,
+	}
+}
+
+func (tc *TokenCache) Token(ctx context.Context, client *http.Client) (string, error) {
+	return tc.get(ctx, client, tc.Fetch)
+}
+
+func (tc *TokenCache) Invalidate(token string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if tc.token == token {
+		tc.token = ""
+		tc.expires = time.Time{}
+	}
+}
+
+func (tc *TokenCache) get(ctx context.Context, client *http.Client, fetch TokenFetcher) (string, error) {
+	tc.mutex.Lock()
+	for {
+		if tc.token != "" && (tc.expires.IsZero() || time.Now().Before(tc.expires)) {
+			token := tc.token
+			tc.mutex.Unlock()
+			return token, nil
+		}
+		f := tc.flight
+		if f == nil {
+			break
+		}
+		tc.mutex.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		// A fetch abandoned because its caller was cancelled says nothing
+		// about ours; try again rather than sharing that error.
+		if f.err == nil || !isContextError(f.err) {
+			return f.token, f.err
+		}
+		tc.mutex.Lock()
+	}
+	f := &tokenFlight{done: make(chan struct{})}
+	tc.flight = f
+	tc.mutex.Unlock()
+
+	token, lifetime, err := fetch(ctx, client)
+
+	tc.mutex.Lock()
+	f.token, f.err = token, err
+	if err == nil {
+		tc.token = token
+		tc.expires = tc.refreshAt(lifetime)
+	}
+	tc.flight = nil
+	tc.mutex.Unlock()
+	close(f.done)
+	return token, err
+}
+
+// refreshAt returns when a token valid for lifetime should be replaced. Short
+// lived tokens are refreshed at half their lifetime rather than RefreshBefore.
+func (tc *TokenCache) refreshAt(lifetime time.Duration) time.Time {
+	if lifetime <= 0 {
+		return time.Time{}
+	}
+	before := tc.RefreshBefore
+	if before > lifetime/2 {
+		before = lifetime / 2
+	}
+	return time.Now().Add(lifetime - before)
+}
+
+// ClientCredentials fetches tokens with the OAuth client credentials grant and
+// caches them according to the expires_in of the token response.
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scope        string
+
+	cache TokenCache
+}
+
+func NewClientCredentials(tokenURL string, clientID string, clientSecret string, scope string) *ClientCredentials {
+	return &ClientCredentials{
+		TokenURL:     tokenURL,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scope:        scope,
+		cache:        TokenCache{RefreshBefore: DefaultRefreshBefore},
+	}
+}
+
+func (cc *ClientCredentials) Token(ctx context.Context, client *http.Client) (string, error) {
+	return cc.cache.get(ctx, client, cc.fetch)
+}
+
+func (cc *ClientCredentials) Invalidate(token string) {
+	cc.cache.Invalidate(token)
+}
+
+func (cc *ClientCredentials) fetch(ctx context.Context, client *http.Client) (string, time.Duration, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if cc.Scope != "" {
+		form.Set("scope", cc.Scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", cc.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(cc.ClientID, cc.ClientSecret)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	bodyBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, &AuthError{StatusCode: resp.StatusCode, URL: cc.TokenURL, Body: string(bodyBytes)}
+	}
+
+	var result struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	err = json.Unmarshal(bodyBytes, &result)
+	if err != nil {
+		return "", 0, err
+	}
+	if result.AccessToken == "" {
+		return "", 0, fmt.Errorf("token response has no access_token")
+	}
+	var lifetime time.Duration
+	if result.ExpiresIn != "" {
+		seconds, err := result.ExpiresIn.Float64()
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid expires_in %q: %w", result.ExpiresIn, err)
+		}
+		lifetime = time.Duration(seconds * float64(time.Second))
+	}
+	return result.AccessToken, lifetime, nil
+}
+
+// StaticToken is a fixed bearer token, useful for short lived scripts and tests.
+type StaticToken string
+
+func (t StaticToken) Token(ctx context.Context, client *http.Client) (string, error) {
+	if t == "" {
+		return "", fmt.Errorf("static token is empty")
+	}
+	return string(t), nil
+}
+
+func (StaticToken) Invalidate(token string) {}
+
+// FileToken reads the bearer token from a file on every call, so an external
+// process can rotate it.
+type FileToken struct {
+	Path string
+}
+
+func (ft FileToken) Token(ctx context.Context, client *http.Client) (string, error) {
+	b, err := os.ReadFile(ft.Path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", ft.Path)
+	}
+	return token, nil
+}
+
+func (FileToken) Invalidate(token string) {}
+
+// EnvToken reads the bearer token from the named environment variable.
+type EnvToken string
+
+func (name EnvToken) Token(ctx context.Context, client *http.Client) (string, error) {
+	token := strings.TrimSpace(os.Getenv(string(name)))
+	if token == "" {
+		return "", fmt.Errorf("environment variable %s is not set", string(name))
+	}
+	return token, nil
+}
+
+func (EnvToken) Invalidate(token string) {}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
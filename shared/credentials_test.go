@@ -0,0 +1,129 @@
+package shared_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+// newTokenServer serves oauth at sharedtest.TokenPath and api, behind
+// oauth.Authorize, everywhere else.
+func newTokenServer(t *testing.T, oauth *sharedtest.OAuth, api http.Handler) (*httptest.Server, *shared.ClientCredentials) {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle(sharedtest.TokenPath, oauth)
+	mux.Handle("/", oauth.Authorize(api))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, shared.NewClientCredentials(server.URL+sharedtest.TokenPath, oauth.ClientID, oauth.ClientSecret, "")
+}
+
+func okHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+}
+
+func TestTokenConcurrentCallersShareOneFetch(t *testing.T) {
+	oauth := sharedtest.NewOAuth("client", "secret")
+	server, creds := newTokenServer(t, oauth, okHandler())
+
+	tokens := make([]string, 20)
+	errs := make([]error, len(tokens))
+	var wg sync.WaitGroup
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], errs[i] = creds.Token(context.Background(), server.Client())
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range tokens {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		if tokens[i] != tokens[0] {
+			t.Errorf("caller %d got token %q, want %q", i, tokens[i], tokens[0])
+		}
+	}
+	if n := oauth.Issued(); n != 1 {
+		t.Errorf("issued %d tokens, want 1", n)
+	}
+}
+
+func TestTokenRefreshedBeforeExpiry(t *testing.T) {
+	oauth := sharedtest.NewOAuth("client", "secret")
+	// A token this short lived is refreshed at half its lifetime.
+	oauth.TokenLifetime = 2 * time.Second
+	server, creds := newTokenServer(t, oauth, okHandler())
+	ctx := context.Background()
+
+	first, err := creds.Token(ctx, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := creds.Token(ctx, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first || oauth.Issued() != 1 {
+		t.Fatalf("token fetched again while fresh")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	second, err := creds.Token(ctx, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || oauth.Issued() != 2 {
+		t.Fatalf("token not refreshed after half its lifetime")
+	}
+	if !oauth.Valid(first) {
+		t.Errorf("token refreshed only after it expired")
+	}
+}
+
+func TestRequestRefreshesTokenOn401(t *testing.T) {
+	oauth := sharedtest.NewOAuth("client", "secret")
+	server, creds := newTokenServer(t, oauth, okHandler())
+	ctx := context.Background()
+	_, err := creds.Token(ctx, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached token is still fresh but the server no longer takes it.
+	oauth.RevokeAll()
+	resp, err := shared.RequestContext(ctx, server.Client(), creds, "GET", server.URL+"/files", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if n := oauth.Issued(); n != 2 {
+		t.Errorf("issued %d tokens, want 2", n)
+	}
+}
+
+func TestRequestSecond401IsAuthError(t *testing.T) {
+	oauth := sharedtest.NewOAuth("client", "secret")
+	api := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sharedtest.WriteJSON(w, http.StatusUnauthorized, map[string]string{"message": "no access"})
+	})
+	server, creds := newTokenServer(t, oauth, api)
+
+	_, err := shared.RequestContext(context.Background(), server.Client(), creds, "GET", server.URL+"/files", nil, nil)
+	var authErr *shared.AuthError
+	if !errors.As(err, &authErr) || !errors.Is(err, shared.ErrUnauthorized) {
+		t.Fatalf("got %v, want an AuthError", err)
+	}
+	if n := oauth.Issued(); n != 2 {
+		t.Errorf("issued %d tokens, want 2", n)
+	}
+}
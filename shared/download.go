@@ -0,0 +1,378 @@
+package shared
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DownloadInfo tells where the content of a stored file is downloaded from.
+// Size is 0 when the service does not report it, and SHA256 is empty when no
+// checksum is stored.
+type DownloadInfo struct {
+	URL    string
+	Size   int64
+	SHA256 string
+}
+
+// Downloader is implemented by services that can resolve the download URL of
+// a stored file.
+type Downloader interface {
+	DownloadInfo(ctx context.Context, fileId string) (DownloadInfo, error)
+}
+
+func Download(service Service, fileId string, dst io.WriterAt, options ...UploadOptions) error {
+	return DownloadContext(context.Background(), service, fileId, dst, options...)
+}
+
+// DownloadContext writes the content of fileId to dst. It is fetched in parts
+// of ChunkSize bytes with up to MaxRoutines concurrent Range requests, and each
+// part is tried up to PartAttempts times. With a Journal the parts written to
+// dst are recorded, so calling DownloadContext again with the same journal and
+// dst only fetches the parts that are missing.
+//
+// The size of every part is checked against the size of the file. With
+// VerifyChecksum the SHA-256 of dst is also compared with the one the service
+// stores, which needs dst to be an io.ReaderAt such as *os.File.
+func DownloadContext(ctx context.Context, service Service, fileId string, dst io.WriterAt, options ...UploadOptions) (err error) {
+	downloader, ok := service.(Downloader)
+	if !ok {
+		return fmt.Errorf("%T cannot download files", service)
+	}
+	opts := withDefaults(options...)
+	defer func() { opts.tracker.step(ProgressDone, err) }()
+
+	info, err := downloader.DownloadInfo(ctx, fileId)
+	if err != nil {
+		return err
+	}
+	if info.URL == "" {
+		return fmt.Errorf("%w: file %s has no download URL", ErrInvalidResponse, fileId)
+	}
+	if info.Size == 0 {
+		info.Size, err = contentSize(ctx, service, info.URL)
+		if err != nil {
+			return err
+		}
+	}
+
+	j, err := openDownloadJournal(opts.Journal, fileId, info, opts.ChunkSize)
+	if err != nil {
+		return err
+	}
+	opts.ChunkSize = j.ChunkSize
+	opts.ContentLength = info.Size
+
+	var missing []int
+	if info.Size > 0 {
+		missing = j.missing(partCount(opts))
+	}
+	var remaining int64
+	for _, part := range missing {
+		remaining += Min(opts.ChunkSize, opts.ContentLength-int64(part-1)*opts.ChunkSize)
+	}
+	opts.tracker.created(fileId, fileId, remaining, len(missing))
+
+	failed, err := getParts(ctx, service, info.URL, dst, j, missing, opts)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return &DownloadError{FileID: fileId, Journal: j.path, Failed: failed}
+	}
+
+	if t, ok := dst.(interface{ Truncate(size int64) error }); ok {
+		err = t.Truncate(info.Size)
+		if err != nil {
+			return err
+		}
+	}
+	err = j.remove()
+	if err != nil {
+		return err
+	}
+	if opts.VerifyChecksum && info.SHA256 != "" {
+		return verifyDownload(dst, info)
+	}
+	return nil
+}
+
+// downloadJournal records the parts of a download already written to dst, so
+// that downloading the same file again to the same dst only fetches the
+// missing ones. It is a separate type from the upload Journal so the two are
+// never mistaken for each other.
+type downloadJournal struct {
+	FileID    string    `json:"fileId"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256,omitempty"`
+	ChunkSize int64     `json:"chunkSize"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Parts     []int     `json:"parts"`
+
+	path  string
+	mutex sync.Mutex
+}
+
+// openDownloadJournal loads the journal of an interrupted download of fileId
+// from path, or starts a new one when there is none or it was kept for other
+// content. With an empty path the journal is only kept in memory.
+func openDownloadJournal(path string, fileId string, info DownloadInfo, chunkSize int64) (*downloadJournal, error) {
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			j := &downloadJournal{}
+			err = json.Unmarshal(b, j)
+			if err != nil {
+				return nil, fmt.Errorf("invalid download journal %s: %w", path, err)
+			}
+			if j.FileID == fileId && j.Size == info.Size && j.SHA256 == info.SHA256 && j.ChunkSize > 0 {
+				j.path = path
+				return j, nil
+			}
+		}
+	}
+	j := &downloadJournal{
+		FileID:    fileId,
+		Size:      info.Size,
+		SHA256:    info.SHA256,
+		ChunkSize: chunkSize,
+		Parts:     []int{},
+		path:      path,
+	}
+	return j, j.save()
+}
+
+// record adds a part written to dst and persists the journal.
+func (j *downloadJournal) record(partNumber int) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Parts = append(j.Parts, partNumber)
+	return j.saveLocked()
+}
+
+// missing returns the part numbers of parts that have not been recorded.
+func (j *downloadJournal) missing(parts int) []int {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	done := make(map[int]bool, len(j.Parts))
+	for _, p := range j.Parts {
+		done[p] = true
+	}
+	return missingParts(parts, done)
+}
+
+func (j *downloadJournal) remove() error {
+	return removeJournal(j.path)
+}
+
+func (j *downloadJournal) save() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.saveLocked()
+}
+
+func (j *downloadJournal) saveLocked() error {
+	if j.path == "" {
+		return nil
+	}
+	j.UpdatedAt = time.Now().UTC()
+	return writeJournal(j.path, j)
+}
+
+// getParts fetches the given parts into dst and records them in j. It returns
+// the parts that failed, ctx.Err() if ctx was cancelled, or the first error
+// updating j.
+func getParts(ctx context.Context, service Service, url string, dst io.WriterAt, j *downloadJournal, parts []int, options UploadOptions) ([]PartError, error) {
+	c := make(chan int)
+	var mutex sync.Mutex
+	var failed []PartError
+	var journalErr error
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < options.MaxRoutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range c {
+				err := getPart(ctx, service, url, dst, part, options)
+				var partErr *PartError
+				if errors.As(err, &partErr) {
+					mutex.Lock()
+					failed = append(failed, *partErr)
+					mutex.Unlock()
+					continue
+				}
+				if err != nil {
+					continue
+				}
+				err = j.record(part)
+				if err != nil {
+					mutex.Lock()
+					if journalErr == nil {
+						journalErr = fmt.Errorf("update journal %s: %w", j.path, err)
+					}
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+send:
+	for _, part := range parts {
+		select {
+		case c <- part:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(c)
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if journalErr != nil {
+		return nil, journalErr
+	}
+	sort.Slice(failed, func(i, k int) bool { return failed[i].PartNumber < failed[k].PartNumber })
+	return failed, nil
+}
+
+// getPart fetches one part into dst, retrying it on any failure up to
+// PartAttempts times. A part that still fails is returned as a *PartError;
+// cancellation is returned as is.
+func getPart(ctx context.Context, service Service, url string, dst io.WriterAt, partNumber int, options UploadOptions) error {
+	policy := service.GetRetryPolicy()
+	start := int64(partNumber-1) * options.ChunkSize
+	length := Min(options.ChunkSize, options.ContentLength-start)
+	partErr := &PartError{PartNumber: partNumber}
+	for attempt := 1; attempt <= options.PartAttempts; attempt++ {
+		if attempt > 1 {
+			if err := sleep(ctx, policy.Backoff(attempt-1)); err != nil {
+				return err
+			}
+		}
+		if err := options.Limiter.Acquire(ctx); err != nil {
+			return err
+		}
+		options.tracker.partStarted(partNumber, attempt)
+		err := getRange(ctx, service, url, dst, start, length, partNumber, options)
+		options.Limiter.Release()
+		if err == nil {
+			options.tracker.partCompleted(partNumber, length)
+			return nil
+		}
+		if ctx.Err() != nil {
+			options.tracker.partFailed(partNumber, attempt, ctx.Err())
+			return ctx.Err()
+		}
+		partErr.Attempts = attempt
+		partErr.Err = err
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			partErr.LastStatus = apiErr.StatusCode
+		} else {
+			partErr.LastStatus = 0
+		}
+	}
+	options.tracker.partFailed(partNumber, partErr.Attempts, partErr)
+	return partErr
+}
+
+// getRange writes the length bytes of the content at url starting at start to
+// the same offset of dst.
+func getRange(ctx context.Context, service Service, url string, dst io.WriterAt, start int64, length int64, partNumber int, options UploadOptions) error {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start, start+length-1)}}
+	resp, err := RequestContext(ctx, service.GetClient(), nil, "GET", url, nil, nil, RequestOptions{Retry: service.GetRetryPolicy(), Header: header})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// A different total means the file changed since its size was read.
+		got := resp.Header.Get("Content-Range")
+		want := fmt.Sprintf("bytes %d-%d/", start, start+length-1)
+		total := strings.TrimPrefix(got, want)
+		if total == got || (total != "*" && total != strconv.FormatInt(options.ContentLength, 10)) {
+			return fmt.Errorf("%w: part %d has Content-Range %q, want %q", ErrInvalidResponse, partNumber, got, want+strconv.FormatInt(options.ContentLength, 10))
+		}
+	case http.StatusOK:
+		// The server ignored the Range header and sent the whole file, which
+		// only holds the part when it is the first one.
+		if start != 0 {
+			return fmt.Errorf("%w: range requests are not supported", ErrInvalidResponse)
+		}
+	default:
+		return fmt.Errorf("%w: part %d returned status %d", ErrInvalidResponse, partNumber, resp.StatusCode)
+	}
+
+	r := options.Limiter.Reader(ctx, resp.Body)
+	if onRead := options.tracker.writer(partNumber); onRead != nil {
+		r = &countingReader{r: r, onRead: onRead}
+	}
+	n, err := io.CopyN(io.NewOffsetWriter(dst, start), r, length)
+	if err == io.EOF {
+		return fmt.Errorf("%w: part %d ended after %d of %d bytes", ErrInvalidResponse, partNumber, n, length)
+	}
+	return err
+}
+
+// contentSize asks for the first byte of the content at url to learn its size
+// from the response.
+func contentSize(ctx context.Context, service Service, url string) (int64, error) {
+	header := http.Header{"Range": {"bytes=0-0"}}
+	resp, err := RequestContext(ctx, service.GetClient(), nil, "GET", url, nil, nil, RequestOptions{Retry: service.GetRetryPolicy(), Header: header})
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// Only an empty file has no first byte.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 {
+		return resp.ContentLength, nil
+	}
+	_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: the size of the file is unknown", ErrInvalidResponse)
+	}
+	return size, nil
+}
+
+// verifyDownload compares the SHA-256 of the content written to dst with the
+// one stored for the file.
+func verifyDownload(dst io.WriterAt, info DownloadInfo) error {
+	r, ok := dst.(io.ReaderAt)
+	if !ok {
+		return fmt.Errorf("cannot verify the download: %T is not an io.ReaderAt", dst)
+	}
+	h := sha256.New()
+	_, err := io.Copy(h, io.NewSectionReader(r, 0, info.Size))
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(sum, info.SHA256) {
+		return &ChecksumError{Algorithm: ChecksumSHA256, Expected: sum, Actual: info.SHA256}
+	}
+	return nil
+}
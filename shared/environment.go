@@ -0,0 +1,166 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variables read by LoadEnvironment. UPLOAD_<SERVICE>_URL sets
+// the base URL of a service, as in UPLOAD_DATAOCEAN_URL.
+const (
+	EnvConfig   = "UPLOAD_CONFIG"
+	EnvProfile  = "UPLOAD_ENV"
+	EnvTokenURL = "UPLOAD_TOKEN_URL"
+	EnvScope    = "UPLOAD_SCOPE"
+	EnvClientID = "UPLOAD_CLIENT_ID"
+)
+
+// Environment is the set of endpoints a client talks to.
+type Environment struct {
+	Name string `json:"name"`
+	// BaseURLs maps a service name, such as "dataocean" or "fileservice", to
+	// the URL its routes are relative to.
+	BaseURLs map[string]string `json:"baseUrls"`
+	TokenURL string            `json:"tokenUrl"`
+	Scope    string            `json:"scope"`
+	// ClientID is the OAuth client the environment is used with. Its secret
+	// is never part of an Environment: callers get it from the user.
+	ClientID string `json:"clientId,omitempty"`
+}
+
+// Profiles are the built-in environments. A config file passed to
+// LoadEnvironment can override their fields or add new ones. Only local comes
+// with base URLs; the others need them from a config file or UPLOAD_*_URL.
+var Profiles = map[string]Environment{
+	"dev": {
+		Name:     "dev",
+		TokenURL: "https://dev.id.trimblecloud.com/oauth/token",
+	},
+	"stage": {
+		Name:     "stage",
+		TokenURL: "https://stage.id.trimblecloud.com/oauth/token",
+	},
+	"prod": {
+		Name:     "prod",
+		TokenURL: "https://id.trimblecloud.com/oauth/token",
+	},
+	"local": {
+		Name: "local",
+		BaseURLs: map[string]string{
+			"dataocean":   "http://localhost:8080",
+			"fileservice": "http://localhost:8081",
+		},
+		TokenURL: "http://localhost:8082/oauth/token",
+	},
+}
+
+// EnvironmentConfig is the content of an environment config file.
+type EnvironmentConfig struct {
+	// Default is the profile used when none is named.
+	Default  string                 `json:"default"`
+	Profiles map[string]Environment `json:"profiles"`
+}
+
+// LoadEnvironment returns the profile called name. Its fields come from the
+// built-in Profiles, then the JSON config file at path, then the UPLOAD_*
+// environment variables, each overriding the one before. An empty path falls
+// back to $UPLOAD_CONFIG and an empty name to $UPLOAD_ENV, then to the default
+// of the config file.
+func LoadEnvironment(path string, name string) (Environment, error) {
+	if path == "" {
+		path = os.Getenv(EnvConfig)
+	}
+	if name == "" {
+		name = os.Getenv(EnvProfile)
+	}
+
+	var config EnvironmentConfig
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return Environment{}, err
+		}
+		err = json.Unmarshal(b, &config)
+		if err != nil {
+			return Environment{}, fmt.Errorf("invalid environment config %s: %w", path, err)
+		}
+	}
+	if name == "" {
+		name = config.Default
+	}
+	if name == "" {
+		return Environment{}, fmt.Errorf("no environment selected: set %s or a default in the config file", EnvProfile)
+	}
+
+	builtin, isBuiltin := Profiles[name]
+	configured, isConfigured := config.Profiles[name]
+	if !isBuiltin && !isConfigured {
+		return Environment{}, fmt.Errorf("unknown environment %q", name)
+	}
+	env := builtin.merge(configured)
+	env.Name = name
+	env = env.merge(environmentFromEnv())
+	if len(env.BaseURLs) == 0 {
+		return Environment{}, fmt.Errorf("environment %q has no base URLs: set baseUrls in a config file or UPLOAD_<SERVICE>_URL", name)
+	}
+	return env, nil
+}
+
+// merge returns e with the fields set in o replacing its own.
+func (e Environment) merge(o Environment) Environment {
+	baseURLs := make(map[string]string, len(e.BaseURLs)+len(o.BaseURLs))
+	for service, url := range e.BaseURLs {
+		baseURLs[service] = url
+	}
+	for service, url := range o.BaseURLs {
+		baseURLs[service] = url
+	}
+	e.BaseURLs = baseURLs
+	if o.Name != "" {
+		e.Name = o.Name
+	}
+	if o.TokenURL != "" {
+		e.TokenURL = o.TokenURL
+	}
+	if o.Scope != "" {
+		e.Scope = o.Scope
+	}
+	if o.ClientID != "" {
+		e.ClientID = o.ClientID
+	}
+	return e
+}
+
+func environmentFromEnv() Environment {
+	env := Environment{
+		BaseURLs: map[string]string{},
+		TokenURL: os.Getenv(EnvTokenURL),
+		Scope:    os.Getenv(EnvScope),
+		ClientID: os.Getenv(EnvClientID),
+	}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if key == EnvTokenURL || value == "" || !strings.HasPrefix(key, "UPLOAD_") || !strings.HasSuffix(key, "_URL") {
+			continue
+		}
+		service := strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(key, "UPLOAD_"), "_URL"))
+		env.BaseURLs[service] = value
+	}
+	return env
+}
+
+// BaseURL returns the base URL of service without a trailing slash.
+func (e Environment) BaseURL(service string) (string, error) {
+	url := strings.TrimSuffix(e.BaseURLs[service], "/")
+	if url == "" {
+		return "", fmt.Errorf("environment %q has no base URL for %s", e.Name, service)
+	}
+	return url, nil
+}
+
+// Credentials returns client credentials for the token URL and scope of e.
+func (e Environment) Credentials(clientID string, clientSecret string) *ClientCredentials {
+	return NewClientCredentials(e.TokenURL, clientID, clientSecret, e.Scope)
+}
@@ -0,0 +1,167 @@
+package shared_test
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/osga1291/upload/shared"
+)
+
+// clearEnvironment unsets every UPLOAD_* variable for the duration of t.
+func clearEnvironment(t *testing.T) {
+	t.Helper()
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, "UPLOAD_") {
+			t.Setenv(key, "")
+		}
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "environments.json")
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testConfig = `{
+  "default": "stage",
+  "profiles": {
+    "stage": {
+      "baseUrls": {"dataocean": "https://dataocean.stage.example.com/api/3.0/"},
+      "scope": "stage-scope",
+      "clientId": "stage-client"
+    },
+    "qa": {
+      "baseUrls": {"fileservice": "https://fileservice.qa.example.com"},
+      "tokenUrl": "https://id.qa.example.com/oauth/token"
+    }
+  }
+}`
+
+func TestLoadEnvironmentProfile(t *testing.T) {
+	clearEnvironment(t)
+	env, err := shared.LoadEnvironment("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(env, shared.Profiles["local"]) {
+		t.Errorf("got %+v, want the built-in local profile", env)
+	}
+
+	t.Setenv(shared.EnvProfile, "local")
+	env, err = shared.LoadEnvironment("", "")
+	if err != nil || env.Name != "local" {
+		t.Errorf("$%s: got %+v, %v", shared.EnvProfile, env, err)
+	}
+}
+
+func TestLoadEnvironmentConfig(t *testing.T) {
+	clearEnvironment(t)
+	path := writeConfig(t, testConfig)
+
+	// The config file fills in the built-in stage profile and names it the
+	// default.
+	env, err := shared.LoadEnvironment(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := shared.Environment{
+		Name:     "stage",
+		BaseURLs: map[string]string{"dataocean": "https://dataocean.stage.example.com/api/3.0/"},
+		TokenURL: shared.Profiles["stage"].TokenURL,
+		Scope:    "stage-scope",
+		ClientID: "stage-client",
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("got %+v, want %+v", env, want)
+	}
+	base, err := env.BaseURL("dataocean")
+	if err != nil || base != "https://dataocean.stage.example.com/api/3.0" {
+		t.Errorf("BaseURL = %q, %v", base, err)
+	}
+	if _, err := env.BaseURL("fileservice"); err == nil {
+		t.Errorf("BaseURL of a service without one did not fail")
+	}
+
+	// Profiles only in the config file work too, and $UPLOAD_CONFIG names
+	// the file.
+	t.Setenv(shared.EnvConfig, path)
+	env, err = shared.LoadEnvironment("", "qa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Name != "qa" || env.TokenURL != "https://id.qa.example.com/oauth/token" || env.BaseURLs["fileservice"] != "https://fileservice.qa.example.com" {
+		t.Errorf("got %+v, want the qa profile of the config", env)
+	}
+}
+
+func TestLoadEnvironmentVariables(t *testing.T) {
+	clearEnvironment(t)
+	path := writeConfig(t, testConfig)
+	t.Setenv("UPLOAD_DATAOCEAN_URL", "http://localhost:9000")
+	t.Setenv("UPLOAD_FILESERVICE_URL", "http://localhost:9001")
+	t.Setenv(shared.EnvTokenURL, "http://localhost:9002/token")
+	t.Setenv(shared.EnvScope, "env-scope")
+	t.Setenv(shared.EnvClientID, "env-client")
+
+	env, err := shared.LoadEnvironment(path, "stage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := shared.Environment{
+		Name: "stage",
+		BaseURLs: map[string]string{
+			"dataocean":   "http://localhost:9000",
+			"fileservice": "http://localhost:9001",
+		},
+		TokenURL: "http://localhost:9002/token",
+		Scope:    "env-scope",
+		ClientID: "env-client",
+	}
+	if !reflect.DeepEqual(env, want) {
+		t.Errorf("got %+v, want %+v", env, want)
+	}
+
+	// The variables also give a built-in profile the base URLs it lacks.
+	env, err = shared.LoadEnvironment("", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.BaseURLs["dataocean"] != "http://localhost:9000" {
+		t.Errorf("got %+v, want the base URLs of the variables", env)
+	}
+}
+
+func TestLoadEnvironmentErrors(t *testing.T) {
+	clearEnvironment(t)
+	path := writeConfig(t, testConfig)
+	tests := []struct {
+		name    string
+		path    string
+		profile string
+		err     string
+	}{
+		{"unknown profile", path, "nope", `unknown environment "nope"`},
+		{"unknown profile without config", "", "nope", `unknown environment "nope"`},
+		{"no profile", "", "", "no environment selected"},
+		{"built-in profile without base URLs", "", "prod", `environment "prod" has no base URLs`},
+		{"missing config", filepath.Join(t.TempDir(), "missing.json"), "local", "no such file"},
+		{"invalid config", writeConfig(t, `{"profiles": [}`), "local", "invalid environment config"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := shared.LoadEnvironment(test.path, test.profile)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got %v, want an error with %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,175 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Sentinel errors matched with errors.Is by the typed errors of this package.
+var (
+	ErrNotFound         = errors.New("not found")
+	ErrUnauthorized     = errors.New("unauthorized")
+	ErrRateLimited      = errors.New("rate limited")
+	ErrProcessingFailed = errors.New("file processing failed")
+	// ErrInvalidPayload is returned when a create payload does not have the
+	// shape the Service expects.
+	ErrInvalidPayload = errors.New("invalid payload")
+	// ErrInvalidResponse is returned when a response lacks a field the client
+	// needs.
+	ErrInvalidResponse = errors.New("invalid response")
+)
+
+// requestIDHeaders are the response headers that may carry the id the server
+// logged the request under.
+var requestIDHeaders = []string{"X-Request-Id", "X-Amzn-Requestid", "X-Amz-Request-Id", "X-Correlation-Id"}
+
+// APIError is returned when the server answers with a status that is not 200,
+// 201, 202, 204 or 206.
+type APIError struct {
+	StatusCode int
+	Method     string
+	// URL is the request URL without its query, which may hold the signature
+	// of a presigned URL.
+	URL       string
+	Body      string
+	RequestID string
+}
+
+// NewAPIError builds an APIError from resp, reading and closing its body.
+func NewAPIError(resp *http.Response) *APIError {
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return newAPIError(resp, bodyBytes)
+}
+
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	e := &APIError{StatusCode: resp.StatusCode, Body: string(body)}
+	if resp.Request != nil {
+		e.Method = resp.Request.Method
+		if resp.Request.URL != nil {
+			u := *resp.Request.URL
+			u.RawQuery = ""
+			e.URL = u.String()
+		}
+	}
+	for _, name := range requestIDHeaders {
+		if id := resp.Header.Get(name); id != "" {
+			e.RequestID = id
+			break
+		}
+	}
+	return e
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("%s %s failed with status %d", e.Method, e.URL, e.StatusCode)
+	if e.RequestID != "" {
+		msg += fmt.Sprintf(" (request id %s)", e.RequestID)
+	}
+	return fmt.Sprintf("%s, response: %s", msg, e.Body)
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// AuthError is returned when a request is still unauthorized after the
+// credentials were refreshed, or when the token endpoint rejects the client.
+type AuthError struct {
+	StatusCode int
+	URL        string
+	Body       string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("unauthorized: status %d from %s: %s", e.StatusCode, e.URL, e.Body)
+}
+
+func (e *AuthError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+// PartError describes a multipart upload part that still failed after every
+// attempt.
+type PartError struct {
+	PartNumber int
+	Attempts   int
+	// LastStatus is the status code of the last failed attempt, or 0 when it
+	// failed before a response was received.
+	LastStatus int
+	Err        error
+}
+
+func (e *PartError) Error() string {
+	return fmt.Sprintf("part %d failed after %d attempts (status %d): %v", e.PartNumber, e.Attempts, e.LastStatus, e.Err)
+}
+
+func (e *PartError) Unwrap() error {
+	return e.Err
+}
+
+// UploadError is returned by MultipartUpload when some parts could not be
+// uploaded. Completed holds the parts that were. With a Journal the upload
+// identified by ID is left for ResumeUpload; without one it has already been
+// aborted by the time the error is returned.
+type UploadError struct {
+	ID        string
+	FileID    string
+	URL       string
+	Completed []AssembleTag
+	Failed    []PartError
+	// Aborted reports whether the upload was aborted, so it can no longer be
+	// resumed.
+	Aborted bool
+}
+
+func (e *UploadError) Error() string {
+	parts := make([]string, len(e.Failed))
+	for i := range e.Failed {
+		parts[i] = e.Failed[i].Error()
+	}
+	return fmt.Sprintf("upload %s: %d parts failed: %s", e.ID, len(e.Failed), strings.Join(parts, "; "))
+}
+
+func (e *UploadError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i := range e.Failed {
+		errs[i] = &e.Failed[i]
+	}
+	return errs
+}
+
+// DownloadError is returned by Download when some parts could not be fetched.
+// Calling Download again with the same Journal fetches only those parts.
+type DownloadError struct {
+	FileID  string
+	Journal string
+	Failed  []PartError
+}
+
+func (e *DownloadError) Error() string {
+	parts := make([]string, len(e.Failed))
+	for i := range e.Failed {
+		parts[i] = e.Failed[i].Error()
+	}
+	return fmt.Sprintf("download %s: %d parts failed: %s", e.FileID, len(e.Failed), strings.Join(parts, "; "))
+}
+
+func (e *DownloadError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i := range e.Failed {
+		errs[i] = &e.Failed[i]
+	}
+	return errs
+}
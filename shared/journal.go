@@ -0,0 +1,363 @@
+package shared
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrJournalExpired is returned by ResumeUpload when the presigned upload URL
+// recorded in the journal is no longer valid.
+var ErrJournalExpired = errors.New("upload URL in journal has expired")
+
+// ErrJournalMismatch is returned when a journal is used with a service other
+// than the one its upload was started on.
+var ErrJournalMismatch = errors.New("journal belongs to another service")
+
+// fingerprintSize is how much of the start of the source is hashed into its
+// Fingerprint.
+const fingerprintSize = 1024 * 1024
+
+// Journal records the progress of a multipart upload on disk so that an
+// interrupted upload can be finished with ResumeUpload.
+type Journal struct {
+	ID        string          `json:"id"`
+	FileID    string          `json:"fileId"`
+	URL       string          `json:"url"`
+	Service   ServiceIdentity `json:"service"`
+	ChunkSize int64           `json:"chunkSize"`
+	Source    Fingerprint     `json:"source"`
+	ExpiresAt time.Time       `json:"expiresAt,omitempty"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+	Parts     []JournalPart   `json:"parts"`
+
+	path  string
+	mutex sync.Mutex
+}
+
+type JournalPart struct {
+	PartNumber int    `json:"partNumber"`
+	Etag       string `json:"etag"`
+}
+
+// ServiceIdentity tells which backend, base URL and space an upload was started
+// on.
+type ServiceIdentity struct {
+	Name    string `json:"name"`
+	BaseURL string `json:"baseUrl"`
+	SpaceID string `json:"spaceId,omitempty"`
+}
+
+func (s ServiceIdentity) String() string {
+	if s.Name == "" {
+		return "unknown service"
+	}
+	if s.SpaceID != "" {
+		return fmt.Sprintf("%s %s space %s", s.Name, s.BaseURL, s.SpaceID)
+	}
+	return s.Name + " " + s.BaseURL
+}
+
+// Identifier is implemented by services that can tell which backend, base URL
+// and space they talk to, so that a journal is only used with the service its
+// upload was started on.
+type Identifier interface {
+	Identity() ServiceIdentity
+}
+
+// identify returns the identity of service, or the zero ServiceIdentity when
+// it is not an Identifier.
+func identify(service Service) ServiceIdentity {
+	if identifier, ok := service.(Identifier); ok {
+		return identifier.Identity()
+	}
+	return ServiceIdentity{}
+}
+
+// Fingerprint identifies the source file of an upload so a journal is never
+// resumed against different content.
+type Fingerprint struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Head    string    `json:"head"`
+}
+
+// JournalPath returns where the journal for file is kept: next to the source
+// when stateDir is empty, otherwise in stateDir under a name derived from the
+// source path.
+func JournalPath(file *os.File, stateDir string) (string, error) {
+	abs, err := filepath.Abs(file.Name())
+	if err != nil {
+		return "", err
+	}
+	if stateDir == "" {
+		return abs + ".upload.json", nil
+	}
+	sum := sha256.Sum256([]byte(abs))
+	name := fmt.Sprintf("%s-%s.upload.json", filepath.Base(abs), hex.EncodeToString(sum[:])[:12])
+	return filepath.Join(stateDir, name), nil
+}
+
+func (f Fingerprint) equal(o Fingerprint) bool {
+	return f.Path == o.Path && f.Size == o.Size && f.ModTime.Equal(o.ModTime) && f.Head == o.Head
+}
+
+func fingerprint(file *os.File) (Fingerprint, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	abs, err := filepath.Abs(file.Name())
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, io.NewSectionReader(file, 0, fingerprintSize))
+	if err != nil {
+		return Fingerprint{}, err
+	}
+	return Fingerprint{
+		Path:    abs,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UTC(),
+		Head:    hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// urlExpiry returns when a presigned URL requested with the urlDuration query
+// parameter expires, or the zero time when it is unknown.
+func urlExpiry(queryParams map[string]string) time.Time {
+	d, err := parseURLDuration(queryParams["urlDuration"])
+	if err != nil || d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d).UTC()
+}
+
+// parseURLDuration accepts Go durations plus a "d" suffix for days, as in "7d".
+func parseURLDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid urlDuration %q", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// newJournal starts the journal of a new upload. With an empty path the
+// journal is only kept in memory.
+func newJournal(path string, service Service, file *os.File, id string, fileId string, url string, chunkSize int64, queryParams map[string]string) (*Journal, error) {
+	j := &Journal{
+		ID:        id,
+		FileID:    fileId,
+		URL:       url,
+		Service:   identify(service),
+		ChunkSize: chunkSize,
+		ExpiresAt: urlExpiry(queryParams),
+		Parts:     []JournalPart{},
+		path:      path,
+	}
+	if path == "" {
+		return j, nil
+	}
+	source, err := fingerprint(file)
+	if err != nil {
+		return nil, err
+	}
+	j.Source = source
+	return j, j.save()
+}
+
+// LoadJournal reads the journal stored at path.
+func LoadJournal(path string) (*Journal, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{}
+	err = json.Unmarshal(b, j)
+	if err != nil {
+		return nil, fmt.Errorf("invalid journal %s: %w", path, err)
+	}
+	j.path = path
+	return j, nil
+}
+
+// Path returns the file the journal is stored in.
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Expired reports whether the presigned upload URL is known to have expired.
+func (j *Journal) Expired() bool {
+	return !j.ExpiresAt.IsZero() && time.Now().After(j.ExpiresAt)
+}
+
+// BelongsTo reports whether the upload of j was started on service.
+func (j *Journal) BelongsTo(service Service) bool {
+	return j.Service == identify(service)
+}
+
+// checkService returns an ErrJournalMismatch unless j belongs to service.
+func (j *Journal) checkService(service Service) error {
+	if !j.BelongsTo(service) {
+		return fmt.Errorf("%w: journal %s is for %s, not %s", ErrJournalMismatch, j.path, j.Service, identify(service))
+	}
+	return nil
+}
+
+// Record adds a completed part and persists the journal.
+func (j *Journal) Record(partNumber int, etag string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.Parts = append(j.Parts, JournalPart{PartNumber: partNumber, Etag: etag})
+	return j.saveLocked()
+}
+
+// Remove deletes the journal once the upload no longer needs it.
+func (j *Journal) Remove() error {
+	return removeJournal(j.path)
+}
+
+func removeJournal(path string) error {
+	if path == "" {
+		return nil
+	}
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (j *Journal) save() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.saveLocked()
+}
+
+func (j *Journal) saveLocked() error {
+	if j.path == "" {
+		return nil
+	}
+	j.UpdatedAt = time.Now().UTC()
+	return writeJournal(j.path, j)
+}
+
+// writeJournal writes v as JSON to path through a temporary file so a crash
+// never leaves a truncated journal behind.
+func writeJournal(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// completed returns the recorded parts as assemble tags, in part order.
+func (j *Journal) completed(service Service) []AssembleTag {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	tags := make([]AssembleTag, 0, len(j.Parts))
+	for _, p := range j.Parts {
+		tags = append(tags, service.CreateTag(p.Etag, p.PartNumber))
+	}
+	sort.Slice(tags, func(i, k int) bool { return tags[i].PartNumber < tags[k].PartNumber })
+	return tags
+}
+
+// missing returns the part numbers of parts that have not been recorded.
+func (j *Journal) missing(parts int) []int {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	done := make(map[int]bool, len(j.Parts))
+	for _, p := range j.Parts {
+		done[p.PartNumber] = true
+	}
+	return missingParts(parts, done)
+}
+
+// missingParts returns the numbers from 1 to parts that are not done.
+func missingParts(parts int, done map[int]bool) []int {
+	var missing []int
+	for i := 1; i <= parts; i++ {
+		if !done[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+func ResumeUpload(service Service, journalPath string, file *os.File, options ...UploadOptions) (string, error) {
+	return ResumeUploadContext(context.Background(), service, journalPath, file, options...)
+}
+
+// ResumeUploadContext finishes the multipart upload recorded in the journal at
+// journalPath: it uploads only the parts that are missing, assembles the file
+// and waits for it to become available. The journal is removed on success.
+// It fails with ErrJournalMismatch when the upload was started on another
+// service, and with ErrJournalExpired once the upload URL has expired.
+func ResumeUploadContext(ctx context.Context, service Service, journalPath string, file *os.File, options ...UploadOptions) (string, error) {
+	j, err := LoadJournal(journalPath)
+	if err != nil {
+		return "", err
+	}
+	err = j.checkService(service)
+	if err != nil {
+		return "", err
+	}
+	if j.Expired() {
+		return "", fmt.Errorf("%w: upload %s expired at %s", ErrJournalExpired, j.ID, j.ExpiresAt)
+	}
+
+	source, err := fingerprint(file)
+	if err != nil {
+		return "", err
+	}
+	if !source.equal(j.Source) {
+		return "", fmt.Errorf("source %s does not match journal %s", file.Name(), journalPath)
+	}
+
+	opts, err := defaultUploadOptions(file, options...)
+	if err != nil {
+		return "", err
+	}
+	opts.ChunkSize = j.ChunkSize
+
+	var sum string
+	if opts.VerifyChecksum {
+		sum, err = hashFile(file)
+		if err != nil {
+			return "", err
+		}
+	}
+	missing := j.missing(partCount(opts))
+	var remaining int64
+	for _, part := range missing {
+		remaining += Min(opts.ChunkSize, opts.ContentLength-int64(part-1)*opts.ChunkSize)
+	}
+	opts.tracker.created(j.ID, j.FileID, remaining, len(missing))
+	return uploadParts(ctx, service, j, opts, fileChunks(file, opts, missing), func() string { return sum })
+}
@@ -0,0 +1,214 @@
+package shared_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/dataocean/dataoceantest"
+	"github.com/osga1291/upload/fileservice"
+	"github.com/osga1291/upload/fileservice/fileservicetest"
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+// interrupt runs a journaled upload of file on service whose part 2 fails and
+// returns the journal it leaves behind. Afterwards ft counts the parts sent
+// without failing them.
+func interrupt(t *testing.T, service shared.Service, ft *sharedtest.FaultTransport, payload shared.Payload, queryParams map[string]string, file *os.File) string {
+	t.Helper()
+	journal := filepath.Join(t.TempDir(), "upload.json")
+	ft.On("PUT", part2, sharedtest.Fault{Reset: true})
+	_, err := shared.MultipartUpload(service, payload, queryParams, file, shared.UploadOptions{ChunkSize: partSize, Journal: journal})
+	var uploadErr *shared.UploadError
+	if !errors.As(err, &uploadErr) {
+		t.Fatalf("got %v, want an UploadError", err)
+	}
+	ft.Clear()
+	ft.On("PUT", parts, sharedtest.Fault{})
+	return journal
+}
+
+// editJournal rewrites the journal at path after edit changes it.
+func editJournal(t *testing.T, path string, edit func(j *shared.Journal)) {
+	t.Helper()
+	j, err := shared.LoadJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit(j)
+	b, err := json.Marshal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, b, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeUploadExpired(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	ft := sharedtest.Install(do.GetClient())
+	file, _ := sharedtest.TempFile(t, fileSize)
+	start := time.Now()
+	journal := interrupt(t, do, ft, dataocean.NewFileRequest("/journal/expired.bin").Multipart(), map[string]string{"urlDuration": "7d"}, file)
+
+	j, err := shared.LoadJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	week := 7 * 24 * time.Hour
+	if j.ExpiresAt.Before(start.Add(week)) || j.ExpiresAt.After(time.Now().Add(week)) {
+		t.Errorf("journal expires at %v, want a week after the upload started at %v", j.ExpiresAt, start)
+	}
+	if j.Expired() {
+		t.Errorf("journal expired right away")
+	}
+
+	editJournal(t, journal, func(j *shared.Journal) { j.ExpiresAt = time.Now().Add(-time.Minute) })
+	_, err = shared.ResumeUpload(do, journal, file)
+	if !errors.Is(err, shared.ErrJournalExpired) {
+		t.Fatalf("got %v, want ErrJournalExpired", err)
+	}
+	if n := ft.Count("PUT", parts); n != 0 {
+		t.Errorf("expired resume sent %d parts", n)
+	}
+	if _, err := os.Stat(journal); err != nil {
+		t.Errorf("expired journal removed: %v", err)
+	}
+}
+
+func TestResumeUploadSourceChanged(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, path string, modTime time.Time)
+	}{
+		{"content", func(t *testing.T, path string, modTime time.Time) {
+			// Same size and modification time, different first byte.
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			content[0]++
+			writeSource(t, path, content, modTime)
+		}},
+		{"size", func(t *testing.T, path string, modTime time.Time) {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeSource(t, path, append(content, 0), modTime)
+		}},
+		{"modification time", func(t *testing.T, path string, modTime time.Time) {
+			err := os.Chtimes(path, modTime, modTime.Add(time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := dataoceantest.NewServer()
+			defer server.Close()
+			do := server.Client()
+			ft := sharedtest.Install(do.GetClient())
+			file, _ := sharedtest.TempFile(t, fileSize)
+			journal := interrupt(t, do, ft, dataocean.NewFileRequest("/journal/changed.bin").Multipart(), nil, file)
+			info, err := file.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.change(t, file.Name(), info.ModTime())
+			_, err = shared.ResumeUpload(do, journal, file)
+			if err == nil || !strings.Contains(err.Error(), "does not match journal") {
+				t.Fatalf("got %v, want a source mismatch", err)
+			}
+			if n := ft.Count("PUT", parts); n != 0 {
+				t.Errorf("resume of a changed source sent %d parts", n)
+			}
+		})
+	}
+}
+
+// writeSource replaces the content of path and gives it modTime.
+func writeSource(t *testing.T, path string, content []byte, modTime time.Time) {
+	t.Helper()
+	err := os.WriteFile(path, content, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeUploadOtherService(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	ft := sharedtest.Install(do.GetClient())
+	file, _ := sharedtest.TempFile(t, fileSize)
+	journal := interrupt(t, do, ft, dataocean.NewFileRequest("/journal/other.bin").Multipart(), nil, file)
+
+	j, err := shared.LoadJournal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Service != do.Identity() || !j.BelongsTo(do) {
+		t.Fatalf("journal records %v, want %v", j.Service, do.Identity())
+	}
+
+	other := dataoceantest.NewServer()
+	defer other.Close()
+	fsServer := fileservicetest.NewServer()
+	defer fsServer.Close()
+	spaceId := fsServer.CreateSpace("journal")
+	fs := fsServer.Client(spaceId)
+	fsFaults := sharedtest.Install(fs.GetClient())
+	fsJournal := interrupt(t, fs, fsFaults, fileservice.NewUploadRequest("other.bin", spaceId).Multipart(), nil, file)
+	otherSpace := fsServer.Client(fsServer.CreateSpace("other"))
+
+	tests := []struct {
+		name    string
+		service shared.Service
+		journal string
+	}{
+		{"DataOcean journal on FileService", fs, journal},
+		{"DataOcean journal on another DataOcean", other.Client(), journal},
+		{"FileService journal on DataOcean", do, fsJournal},
+		{"FileService journal in another space", otherSpace, fsJournal},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := shared.ResumeUpload(test.service, test.journal, file)
+			if !errors.Is(err, shared.ErrJournalMismatch) {
+				t.Fatalf("got %v, want ErrJournalMismatch", err)
+			}
+		})
+	}
+	if n := ft.Count("PUT", parts) + fsFaults.Count("PUT", parts); n != 0 {
+		t.Errorf("resume on another service sent %d parts", n)
+	}
+
+	// The journals still resume on their own service.
+	for _, resume := range []struct {
+		service shared.Service
+		journal string
+	}{{do, journal}, {fs, fsJournal}} {
+		_, err := shared.ResumeUploadContext(context.Background(), resume.service, resume.journal, file)
+		if err != nil {
+			t.Errorf("resume of %s: %v", resume.journal, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package shared
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// minBurst is the smallest number of bytes the bucket of a Limiter holds, so
+// low rates still send reasonably sized writes.
+const minBurst = 32 * 1024
+
+// Limiter caps the bandwidth and the number of parts in flight of every upload
+// it is passed to, so a batch of concurrent uploads shares one budget. A nil
+// *Limiter does not limit anything.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+
+	inFlight chan struct{}
+}
+
+// NewLimiter returns a Limiter allowing bytesPerSecond bytes per second and
+// maxInFlight parts uploading at once. A value of 0 or less leaves that limit
+// off.
+func NewLimiter(bytesPerSecond int64, maxInFlight int) *Limiter {
+	l := &Limiter{}
+	if bytesPerSecond > 0 {
+		l.rate = float64(bytesPerSecond)
+		l.burst = l.rate
+		if l.burst < minBurst {
+			l.burst = minBurst
+		}
+		l.tokens = l.burst
+		l.last = time.Now()
+	}
+	if maxInFlight > 0 {
+		l.inFlight = make(chan struct{}, maxInFlight)
+	}
+	return l
+}
+
+// Acquire waits for a free in-flight slot. Every successful Acquire must be
+// followed by a Release.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil || l.inFlight == nil {
+		return ctx.Err()
+	}
+	select {
+	case l.inFlight <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *Limiter) Release() {
+	if l == nil || l.inFlight == nil {
+		return
+	}
+	<-l.inFlight
+}
+
+// WaitN waits until n bytes may be sent. n must not exceed the burst of the
+// Limiter, which Reader takes care of.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || l.rate == 0 || n <= 0 {
+		return ctx.Err()
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// Take the tokens right away, going into debt if needed, so concurrent
+	// waiters queue up behind each other instead of all waking at once.
+	l.tokens -= float64(n)
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mutex.Unlock()
+
+	err := sleep(ctx, wait)
+	if err != nil {
+		l.mutex.Lock()
+		l.tokens += float64(n)
+		l.mutex.Unlock()
+	}
+	return err
+}
+
+// Reader returns r throttled to the bandwidth of the Limiter.
+func (l *Limiter) Reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil || l.rate == 0 {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *Limiter
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	if len(b) > int(r.limiter.burst) {
+		b = b[:int(r.limiter.burst)]
+	}
+	n, err := r.r.Read(b)
+	if n > 0 {
+		waitErr := r.limiter.WaitN(r.ctx, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,117 @@
+package shared_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/osga1291/upload/shared"
+)
+
+func TestLimiterInFlight(t *testing.T) {
+	const max = 3
+	limiter := shared.NewLimiter(0, max)
+	var mutex sync.Mutex
+	inFlight, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := limiter.Acquire(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			inFlight++
+			if inFlight > peak {
+				peak = inFlight
+			}
+			mutex.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mutex.Lock()
+			inFlight--
+			mutex.Unlock()
+			limiter.Release()
+		}()
+	}
+	wg.Wait()
+	if peak != max {
+		t.Errorf("%d parts in flight at most, want %d", peak, max)
+	}
+}
+
+func TestLimiterAcquireCancelled(t *testing.T) {
+	limiter := shared.NewLimiter(0, 1)
+	err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- limiter.Acquire(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire still waiting a second after it was cancelled")
+	}
+
+	// The cancelled Acquire did not take the slot.
+	limiter.Release()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = limiter.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("slot not free after Release: %v", err)
+	}
+}
+
+func TestLimiterReaderRate(t *testing.T) {
+	const rate = 1024 * 1024
+	limiter := shared.NewLimiter(rate, 0)
+	// The first second worth of bytes is the burst; the rest is throttled.
+	content := make([]byte, rate+rate/2)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, limiter.Reader(context.Background(), bytes.NewReader(content)))
+	elapsed := time.Since(start)
+	if err != nil || n != int64(len(content)) {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+	if elapsed < 400*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Errorf("read %d bytes at %d per second in %v, want about 500ms", n, rate, elapsed)
+	}
+}
+
+func TestLimiterReaderCancelled(t *testing.T) {
+	limiter := shared.NewLimiter(64*1024, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := io.Copy(io.Discard, limiter.Reader(ctx, bytes.NewReader(make([]byte, 1024*1024))))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var limiter *shared.Limiter
+	r := bytes.NewReader(nil)
+	if limiter.Reader(context.Background(), r) != io.Reader(r) {
+		t.Errorf("nil Limiter wraps the reader")
+	}
+	err := limiter.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.Release()
+}
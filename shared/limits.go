@@ -0,0 +1,66 @@
+package shared
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooManyParts is returned before an upload is created when the file cannot
+// be split into parts within the limits of the backend.
+var ErrTooManyParts = errors.New("file needs more parts than the backend allows")
+
+// PartLimits are the multipart constraints a backend imposes. A zero field
+// means no limit.
+type PartLimits struct {
+	MaxParts    int
+	MinPartSize int64
+	MaxPartSize int64
+}
+
+// chunkAlignment is the granularity automatically sized chunks are rounded to.
+const chunkAlignment = 1024 * 1024
+
+// sizeChunks checks options.ChunkSize against limits and, with AutoChunkSize,
+// grows it so that options.ContentLength fits in limits.MaxParts parts.
+func sizeChunks(options UploadOptions, limits PartLimits) (UploadOptions, error) {
+	if options.AutoChunkSize {
+		if limits.MaxParts > 0 && options.ContentLength > 0 {
+			need := (options.ContentLength + int64(limits.MaxParts) - 1) / int64(limits.MaxParts)
+			need = (need + chunkAlignment - 1) / chunkAlignment * chunkAlignment
+			if need > options.ChunkSize {
+				options.ChunkSize = need
+			}
+		}
+		if options.ChunkSize < limits.MinPartSize {
+			options.ChunkSize = limits.MinPartSize
+		}
+		if limits.MaxPartSize > 0 && options.ChunkSize > limits.MaxPartSize {
+			options.ChunkSize = limits.MaxPartSize
+		}
+	}
+
+	// Only the last part may be smaller than the minimum.
+	if options.ChunkSize < limits.MinPartSize && options.ContentLength > options.ChunkSize {
+		return UploadOptions{}, fmt.Errorf("chunk size %d is below the minimum part size %d", options.ChunkSize, limits.MinPartSize)
+	}
+	if limits.MaxPartSize > 0 && options.ChunkSize > limits.MaxPartSize {
+		return UploadOptions{}, fmt.Errorf("chunk size %d is above the maximum part size %d", options.ChunkSize, limits.MaxPartSize)
+	}
+	if limits.MaxParts > 0 {
+		parts := partCount(options)
+		if parts > limits.MaxParts {
+			return UploadOptions{}, fmt.Errorf("%w: %d bytes in chunks of %d need %d parts, the limit is %d",
+				ErrTooManyParts, options.ContentLength, options.ChunkSize, parts, limits.MaxParts)
+		}
+	}
+	return options, nil
+}
+
+// partCount returns how many parts the upload is split into.
+func partCount(options UploadOptions) int {
+	parts := int((options.ContentLength + options.ChunkSize - 1) / options.ChunkSize)
+	if parts == 0 {
+		parts = 1
+	}
+	return parts
+}
@@ -0,0 +1,58 @@
+package shared
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSizeChunks(t *testing.T) {
+	const mib = 1024 * 1024
+	limits := PartLimits{MaxParts: 10, MinPartSize: 5 * mib, MaxPartSize: 100 * mib}
+	tests := []struct {
+		name    string
+		limits  PartLimits
+		options UploadOptions
+		want    int64
+		// err is part of the expected error message; empty means none.
+		err string
+	}{
+		{"auto raised to the minimum", limits, UploadOptions{AutoChunkSize: true, ChunkSize: mib, ContentLength: 20 * mib}, 5 * mib, ""},
+		{"auto lowered to the maximum", limits, UploadOptions{AutoChunkSize: true, ChunkSize: 200 * mib, ContentLength: 20 * mib}, 100 * mib, ""},
+		{"auto kept", limits, UploadOptions{AutoChunkSize: true, ChunkSize: 8 * mib, ContentLength: 20 * mib}, 8 * mib, ""},
+		{"auto grown to the part limit", limits, UploadOptions{AutoChunkSize: true, ChunkSize: 5 * mib, ContentLength: 100 * mib}, 10 * mib, ""},
+		{"auto grown and aligned", limits, UploadOptions{AutoChunkSize: true, ChunkSize: 5 * mib, ContentLength: 100*mib + 1}, 11 * mib, ""},
+		{"auto unknown size", limits, UploadOptions{AutoChunkSize: true, ChunkSize: 8 * mib}, 8 * mib, ""},
+		{"auto too big", limits, UploadOptions{AutoChunkSize: true, ChunkSize: 5 * mib, ContentLength: 1000*mib + 1}, 0, "need 11 parts"},
+		{"auto without limits", PartLimits{}, UploadOptions{AutoChunkSize: true, ChunkSize: 1, ContentLength: 1000 * mib}, 1, ""},
+		{"below the minimum", limits, UploadOptions{ChunkSize: mib, ContentLength: 20 * mib}, 0, "below the minimum"},
+		{"single part below the minimum", limits, UploadOptions{ChunkSize: mib, ContentLength: mib}, mib, ""},
+		{"unknown size below the minimum", limits, UploadOptions{ChunkSize: mib}, mib, ""},
+		{"above the maximum", limits, UploadOptions{ChunkSize: 200 * mib, ContentLength: 20 * mib}, 0, "above the maximum"},
+		{"too many parts", limits, UploadOptions{ChunkSize: 5 * mib, ContentLength: 100 * mib}, 0, "need 20 parts"},
+		{"at the part limit", limits, UploadOptions{ChunkSize: 5 * mib, ContentLength: 50 * mib}, 5 * mib, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := sizeChunks(test.options, test.limits)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, want an error with %q", err, test.err)
+				}
+				if strings.HasPrefix(test.err, "need") && !errors.Is(err, ErrTooManyParts) {
+					t.Errorf("got %v, want ErrTooManyParts", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ChunkSize != test.want {
+				t.Errorf("chunk size %d, want %d", got.ChunkSize, test.want)
+			}
+			if n := partCount(got); test.limits.MaxParts > 0 && n > test.limits.MaxParts {
+				t.Errorf("%d parts, above the limit of %d", n, test.limits.MaxParts)
+			}
+		})
+	}
+}
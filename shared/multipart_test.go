@@ -0,0 +1,446 @@
+package shared_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/dataocean/dataoceantest"
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+const (
+	partSize = 5 * 1024 * 1024
+	// fileSize gives three parts, the last one short.
+	fileSize = 2*partSize + 1024*1024
+
+	parts   = "/blobs/*/parts/*"
+	part2   = "/blobs/*/parts/2"
+	create  = "/files"
+	getFile = "/files/*"
+)
+
+func TestMultipartUploadFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		faults func(ft *sharedtest.FaultTransport)
+		// check is called with the result of the upload.
+		check func(t *testing.T, server *dataoceantest.Server, ft *sharedtest.FaultTransport, err error)
+	}{
+		{
+			name: "part answered 503 is retried",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("PUT", part2, sharedtest.Fault{Status: http.StatusServiceUnavailable}, 1, 2)
+			},
+			check: func(t *testing.T, _ *dataoceantest.Server, ft *sharedtest.FaultTransport, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n := ft.Count("PUT", part2); n != 3 {
+					t.Errorf("part 2 sent %d times, want 3", n)
+				}
+			},
+		},
+		{
+			name: "connection reset while sending a part",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("PUT", part2, sharedtest.Fault{Reset: true}, 1)
+			},
+			check: func(t *testing.T, _ *dataoceantest.Server, ft *sharedtest.FaultTransport, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n := ft.Count("PUT", part2); n != 2 {
+					t.Errorf("part 2 sent %d times, want 2", n)
+				}
+			},
+		},
+		{
+			name: "slow parts",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("PUT", parts, sharedtest.Fault{Latency: 50 * time.Millisecond})
+			},
+			check: func(t *testing.T, _ *dataoceantest.Server, _ *sharedtest.FaultTransport, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "401 refreshes the token",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("POST", create, sharedtest.Fault{Status: http.StatusUnauthorized}, 1)
+			},
+			check: func(t *testing.T, server *dataoceantest.Server, _ *sharedtest.FaultTransport, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n := server.OAuth.Issued(); n != 2 {
+					t.Errorf("issued %d tokens, want 2", n)
+				}
+			},
+		},
+		{
+			name: "401 after a refresh is an AuthError",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("POST", create, sharedtest.Fault{Status: http.StatusUnauthorized})
+			},
+			check: func(t *testing.T, _ *dataoceantest.Server, _ *sharedtest.FaultTransport, err error) {
+				var authErr *shared.AuthError
+				if !errors.As(err, &authErr) || !errors.Is(err, shared.ErrUnauthorized) {
+					t.Fatalf("got %v, want an AuthError", err)
+				}
+			},
+		},
+		{
+			name: "part without an ETag once",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("PUT", part2, sharedtest.Fault{DropHeaders: []string{"Etag"}}, 1)
+			},
+			check: func(t *testing.T, _ *dataoceantest.Server, ft *sharedtest.FaultTransport, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n := ft.Count("PUT", part2); n != 2 {
+					t.Errorf("part 2 sent %d times, want 2", n)
+				}
+			},
+		},
+		{
+			name: "part without an ETag",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("PUT", part2, sharedtest.Fault{DropHeaders: []string{"Etag"}})
+			},
+			check: func(t *testing.T, _ *dataoceantest.Server, ft *sharedtest.FaultTransport, err error) {
+				var uploadErr *shared.UploadError
+				if !errors.As(err, &uploadErr) || !errors.Is(err, shared.ErrInvalidResponse) {
+					t.Fatalf("got %v, want an UploadError for a missing ETag", err)
+				}
+				if len(uploadErr.Failed) != 1 || uploadErr.Failed[0].PartNumber != 2 {
+					t.Fatalf("failed parts %+v, want part 2", uploadErr.Failed)
+				}
+				// A part without an ETag is sent again like any failed part.
+				if got := uploadErr.Failed[0]; got.Attempts != 3 || got.LastStatus != http.StatusOK {
+					t.Errorf("part 2 failed after %d attempts with status %d, want 3 and 200", got.Attempts, got.LastStatus)
+				}
+				if n := ft.Count("PUT", part2); n != 3 {
+					t.Errorf("part 2 sent %d times, want 3", n)
+				}
+				if !uploadErr.Aborted {
+					t.Errorf("upload without a journal not aborted")
+				}
+			},
+		},
+		{
+			name: "part failing every attempt",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("PUT", part2, sharedtest.Fault{Status: http.StatusInternalServerError})
+			},
+			check: func(t *testing.T, server *dataoceantest.Server, ft *sharedtest.FaultTransport, err error) {
+				var partErr *shared.PartError
+				if !errors.As(err, &partErr) || partErr.PartNumber != 2 || partErr.LastStatus != http.StatusInternalServerError {
+					t.Fatalf("got %v, want a PartError for part 2", err)
+				}
+				// Every part attempt makes every attempt of the retry policy.
+				want := 3 * shared.DefaultRetryPolicy.MaxAttempts
+				if n := ft.Count("PUT", part2); n != want {
+					t.Errorf("part 2 sent %d times, want %d", n, want)
+				}
+			},
+		},
+		{
+			name: "create answered 500 is not retried",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("POST", create, sharedtest.Fault{Status: http.StatusInternalServerError}, 1)
+			},
+			check: func(t *testing.T, _ *dataoceantest.Server, ft *sharedtest.FaultTransport, err error) {
+				var apiErr *shared.APIError
+				if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+					t.Fatalf("got %v, want an APIError with status 500", err)
+				}
+				if n := ft.Count("POST", create); n != 1 {
+					t.Errorf("create sent %d times, want 1", n)
+				}
+			},
+		},
+		{
+			name: "create answered 503 is retried",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("POST", create, sharedtest.Fault{Status: http.StatusServiceUnavailable}, 1)
+			},
+			check: func(t *testing.T, _ *dataoceantest.Server, ft *sharedtest.FaultTransport, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if n := ft.Count("POST", create); n != 2 {
+					t.Errorf("create sent %d times, want 2", n)
+				}
+			},
+		},
+		{
+			name: "truncated create response",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("POST", create, sharedtest.Fault{Truncate: 10})
+			},
+			check: func(t *testing.T, _ *dataoceantest.Server, _ *sharedtest.FaultTransport, err error) {
+				if !errors.Is(err, shared.ErrInvalidResponse) {
+					t.Fatalf("got %v, want ErrInvalidResponse", err)
+				}
+			},
+		},
+		{
+			name: "processing status unavailable",
+			faults: func(ft *sharedtest.FaultTransport) {
+				ft.On("GET", getFile, sharedtest.Fault{Status: http.StatusServiceUnavailable}, 1, 2, 3)
+			},
+			check: func(t *testing.T, _ *dataoceantest.Server, _ *sharedtest.FaultTransport, err error) {
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := dataoceantest.NewServer()
+			defer server.Close()
+			do := server.Client()
+			ft := sharedtest.Install(do.GetClient())
+			test.faults(ft)
+			file, content := sharedtest.TempFile(t, fileSize)
+
+			fileId, err := shared.MultipartUpload(do, dataocean.NewFileRequest("/faults/file.bin").Multipart(), nil, file, shared.UploadOptions{ChunkSize: partSize, MaxRoutines: 3})
+			test.check(t, server, ft, err)
+			if err == nil {
+				stored, _ := server.Content(fileId)
+				if !bytes.Equal(stored, content) {
+					t.Errorf("stored content differs from the source")
+				}
+			}
+		})
+	}
+}
+
+func TestMultipartUploadResumesAfterFault(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	ft := sharedtest.Install(do.GetClient())
+	ft.On("PUT", part2, sharedtest.Fault{Reset: true})
+	file, content := sharedtest.TempFile(t, fileSize)
+	journal := filepath.Join(t.TempDir(), "upload.json")
+
+	_, err := shared.MultipartUpload(do, dataocean.NewFileRequest("/faults/resumed.bin").Multipart(), nil, file, shared.UploadOptions{ChunkSize: partSize, Journal: journal})
+	var uploadErr *shared.UploadError
+	if !errors.As(err, &uploadErr) {
+		t.Fatalf("got %v, want an UploadError", err)
+	}
+	if len(uploadErr.Completed) != 2 {
+		t.Fatalf("completed parts %+v, want 2", uploadErr.Completed)
+	}
+	if uploadErr.Aborted {
+		t.Fatalf("journaled upload aborted")
+	}
+
+	ft.Clear()
+	ft.On("PUT", parts, sharedtest.Fault{})
+	fileId, err := shared.ResumeUploadContext(context.Background(), do, journal, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ft.Count("PUT", parts); n != 1 {
+		t.Errorf("resume sent %d parts, want only the failed one", n)
+	}
+	stored, _ := server.Content(fileId)
+	if !bytes.Equal(stored, content) {
+		t.Errorf("stored content differs from the source")
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Errorf("journal was not removed: %v", err)
+	}
+}
+
+func TestMultipartUploadCancelled(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	server := dataoceantest.NewServer()
+	do := server.Client()
+	ft := sharedtest.Install(do.GetClient())
+	// Part 2 hangs until the upload is cancelled.
+	block := make(chan struct{})
+	defer close(block)
+	ft.On("PUT", part2, sharedtest.Fault{Block: block})
+	ft.On("DELETE", getFile, sharedtest.Fault{})
+	file, _ := sharedtest.TempFile(t, fileSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := shared.MultipartUploadContext(ctx, do, dataocean.NewFileRequest("/faults/cancelled.bin").Multipart(), nil, file, shared.UploadOptions{ChunkSize: partSize, MaxRoutines: 3})
+		done <- err
+	}()
+	for ft.Count("PUT", part2) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upload still running a second after it was cancelled")
+	}
+	if n := ft.Count("DELETE", getFile); n != 1 {
+		t.Errorf("upload aborted %d times, want 1", n)
+	}
+
+	do.GetClient().CloseIdleConnections()
+	server.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left running, %d before the upload:\n%s", runtime.NumGoroutine(), goroutines, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDownloadTruncatedPart(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	file, content := sharedtest.TempFile(t, fileSize)
+	fileId, err := shared.Upload(do, dataocean.NewFileRequest("/faults/download.bin").Multipart(), nil, file, shared.UploadOptions{ChunkSize: partSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ft := sharedtest.Install(do.GetClient())
+	ft.On("GET", "/blobs/*", sharedtest.Fault{Truncate: 1000}, 2)
+	dst, err := os.Create(filepath.Join(t.TempDir(), "download"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	err = shared.Download(do, fileId, dst, shared.UploadOptions{ChunkSize: partSize, VerifyChecksum: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(dst.Name())
+	if !bytes.Equal(got, content) {
+		t.Errorf("downloaded content differs from the upload")
+	}
+}
+
+func TestDownloadResumesFromJournal(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	file, content := sharedtest.TempFile(t, fileSize)
+	fileId, err := shared.Upload(do, dataocean.NewFileRequest("/faults/journaled.bin").Multipart(), nil, file, shared.UploadOptions{ChunkSize: partSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One part at a time, so part 2 is the one whose two attempts fail.
+	ft := sharedtest.Install(do.GetClient())
+	ft.On("GET", "/blobs/*", sharedtest.Fault{Status: http.StatusForbidden}, 2, 3)
+	dir := t.TempDir()
+	dst, err := os.Create(filepath.Join(dir, "download"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	journal := dst.Name() + ".download.json"
+	opts := shared.UploadOptions{ChunkSize: partSize, MaxRoutines: 1, PartAttempts: 2, Journal: journal}
+	err = shared.Download(do, fileId, dst, opts)
+	var downloadErr *shared.DownloadError
+	if !errors.As(err, &downloadErr) || len(downloadErr.Failed) != 1 || downloadErr.Failed[0].PartNumber != 2 {
+		t.Fatalf("got %v, want a DownloadError for part 2", err)
+	}
+
+	// The download journal is not an upload journal.
+	b, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded map[string]interface{}
+	json.Unmarshal(b, &recorded)
+	if recorded["fileId"] != fileId || recorded["sha256"] != sharedtest.SHA256(content) || recorded["url"] != nil || recorded["source"] != nil {
+		t.Errorf("download journal %s", b)
+	}
+	if parts, _ := recorded["parts"].([]interface{}); len(parts) != 2 {
+		t.Errorf("journal records parts %v, want 1 and 3", recorded["parts"])
+	}
+	uploads, err := shared.ListJournals(dir)
+	if err != nil || len(uploads) != 0 {
+		t.Errorf("ListJournals found %d upload journals, %v", len(uploads), err)
+	}
+
+	ft.Clear()
+	ft.On("GET", "/blobs/*", sharedtest.Fault{})
+	err = shared.Download(do, fileId, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ft.Count("GET", "/blobs/*"); n != 1 {
+		t.Errorf("resumed download fetched %d parts, want only the failed one", n)
+	}
+	got, _ := os.ReadFile(dst.Name())
+	if !bytes.Equal(got, content) {
+		t.Errorf("downloaded content differs from the upload")
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Errorf("journal was not removed: %v", err)
+	}
+}
+
+func TestMultipartUploadJournalWriteFails(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	ft := sharedtest.Install(do.GetClient())
+	block := make(chan struct{})
+	ft.On("PUT", parts, sharedtest.Fault{Block: block}, 1)
+	ft.On("DELETE", getFile, sharedtest.Fault{})
+	file, _ := sharedtest.TempFile(t, fileSize)
+	journal := filepath.Join(t.TempDir(), "upload.json")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := shared.MultipartUpload(do, dataocean.NewFileRequest("/faults/journal.bin").Multipart(), nil, file, shared.UploadOptions{ChunkSize: partSize, MaxRoutines: 1, Journal: journal})
+		done <- err
+	}()
+	for ft.Count("PUT", parts) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The journal is written through journal.tmp, which can no longer be
+	// created.
+	err := os.Mkdir(journal+".tmp", 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(block)
+
+	err = <-done
+	if err == nil || !strings.Contains(err.Error(), "update journal") {
+		t.Fatalf("got %v, want the journal error", err)
+	}
+	if n := ft.Count("DELETE", getFile); n != 1 {
+		t.Errorf("upload aborted %d times, want 1", n)
+	}
+}
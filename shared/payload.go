@@ -0,0 +1,57 @@
+package shared
+
+import (
+	"encoding/json"
+)
+
+// Payload is the body of the request that creates a file. It is sent as its
+// JSON encoding. The backends provide typed builders for it, and untyped maps
+// are adapted with Service.WrapPayload.
+type Payload interface {
+	IsMultipart() bool
+	SetMultipart(multipart bool)
+	// SetChecksum records the SHA-256 of the file, for services that verify
+	// it once the file is available.
+	SetChecksum(sha256 string)
+}
+
+// MapPayload adapts an untyped map to Payload. Object names the nested object
+// holding the file fields, such as "file", or is empty when the fields are at
+// the top level.
+type MapPayload struct {
+	Fields map[string]interface{}
+	Object string
+}
+
+// fields returns the map holding the file fields, creating it if needed.
+func (p *MapPayload) fields() map[string]interface{} {
+	if p.Fields == nil {
+		p.Fields = map[string]interface{}{}
+	}
+	if p.Object == "" {
+		return p.Fields
+	}
+	object, ok := p.Fields[p.Object].(map[string]interface{})
+	if !ok {
+		object = map[string]interface{}{}
+		p.Fields[p.Object] = object
+	}
+	return object
+}
+
+func (p *MapPayload) IsMultipart() bool {
+	multipart, _ := p.fields()["multipart"].(bool)
+	return multipart
+}
+
+func (p *MapPayload) SetMultipart(multipart bool) {
+	p.fields()["multipart"] = multipart
+}
+
+func (p *MapPayload) SetChecksum(sha256 string) {
+	p.fields()["sha256"] = sha256
+}
+
+func (p *MapPayload) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.Fields)
+}
@@ -0,0 +1,52 @@
+package shared_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/osga1291/upload/shared"
+)
+
+func TestMapPayload(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]interface{}
+		object string
+		// edit changes the payload after IsMultipart is checked against
+		// multipart.
+		edit      func(p shared.Payload)
+		multipart bool
+		want      string
+	}{
+		{"top level", map[string]interface{}{"name": "a.bin"}, "", func(p shared.Payload) { p.SetMultipart(true) }, false,
+			`{"multipart":true,"name":"a.bin"}`},
+		{"nil fields", nil, "", func(p shared.Payload) { p.SetChecksum("abc") }, false,
+			`{"sha256":"abc"}`},
+		{"under file", map[string]interface{}{"file": map[string]interface{}{"path": "/a.bin"}}, "file", func(p shared.Payload) { p.SetMultipart(true) }, false,
+			`{"file":{"multipart":true,"path":"/a.bin"}}`},
+		{"no file object", map[string]interface{}{"other": 1}, "file", func(p shared.Payload) { p.SetMultipart(true) }, false,
+			`{"file":{"multipart":true},"other":1}`},
+		{"file is not an object", map[string]interface{}{"file": "/a.bin"}, "file", func(p shared.Payload) { p.SetChecksum("abc") }, false,
+			`{"file":{"sha256":"abc"}}`},
+		{"multipart cleared", map[string]interface{}{"file": map[string]interface{}{"multipart": true}}, "file", func(p shared.Payload) { p.SetMultipart(false) }, true,
+			`{"file":{"multipart":false}}`},
+		{"multipart not a bool", map[string]interface{}{"multipart": "yes"}, "", func(p shared.Payload) {}, false,
+			`{"multipart":"yes"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := &shared.MapPayload{Fields: test.fields, Object: test.object}
+			if p.IsMultipart() != test.multipart {
+				t.Errorf("IsMultipart = %v, want %v", p.IsMultipart(), test.multipart)
+			}
+			test.edit(p)
+			b, err := json.Marshal(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != test.want {
+				t.Errorf("got %s, want %s", b, test.want)
+			}
+		})
+	}
+}
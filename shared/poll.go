@@ -0,0 +1,119 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrPollTimeout is returned when a resource is still not done once the
+	// Timeout of a Poller has passed.
+	ErrPollTimeout = errors.New("timed out waiting for resource")
+	// ErrUnknownStatus is returned together with ErrPollTimeout when the last
+	// status reported was not in the States of the Poller.
+	ErrUnknownStatus = errors.New("unknown status")
+)
+
+// PollState tells a Poller what a status means.
+type PollState int
+
+const (
+	PollPending PollState = iota + 1
+	PollSuccess
+	PollFailure
+)
+
+// Poller waits for a resource to reach a terminal status, polling it at
+// intervals growing exponentially from InitialInterval up to MaxInterval.
+type Poller struct {
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// Multiplier grows the interval after every poll. Values below 1 keep
+	// it constant.
+	Multiplier float64
+	// Timeout bounds the whole wait. 0 means no bound.
+	Timeout time.Duration
+	// States maps every status the resource may report to its state.
+	// Unknown statuses are polled again until Timeout.
+	States map[string]PollState
+}
+
+var DefaultPoller = Poller{
+	InitialInterval: 500 * time.Millisecond,
+	MaxInterval:     15 * time.Second,
+	Multiplier:      2,
+	Timeout:         30 * time.Minute,
+}
+
+// WithStates returns a copy of p using states.
+func (p Poller) WithStates(states map[string]PollState) Poller {
+	p.States = states
+	return p
+}
+
+// Wait calls status until it returns a status whose state is PollSuccess. A
+// PollFailure status is returned as an error matching ErrProcessingFailed, and
+// errors from status are returned as is. resource names what is waited for in
+// errors.
+func (p Poller) Wait(ctx context.Context, resource string, status func(ctx context.Context) (string, error)) error {
+	parent := ctx
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+
+	var last string
+	polled := false
+	interval := p.InitialInterval
+	if interval <= 0 {
+		interval = DefaultPoller.InitialInterval
+	}
+	for {
+		s, err := status(ctx)
+		if err != nil {
+			if ctx.Err() != nil && parent.Err() == nil {
+				return p.timeout(resource, last, polled)
+			}
+			return err
+		}
+		last, polled = s, true
+		switch p.States[s] {
+		case PollSuccess:
+			return nil
+		case PollFailure:
+			return fmt.Errorf("%w: %s has status %s", ErrProcessingFailed, resource, s)
+		}
+
+		err = sleep(ctx, interval)
+		if err != nil {
+			if parent.Err() == nil {
+				return p.timeout(resource, last, polled)
+			}
+			return err
+		}
+		interval = p.next(interval)
+	}
+}
+
+func (p Poller) next(interval time.Duration) time.Duration {
+	if p.Multiplier > 1 {
+		interval = time.Duration(float64(interval) * p.Multiplier)
+	}
+	if p.MaxInterval > 0 && interval > p.MaxInterval {
+		interval = p.MaxInterval
+	}
+	return interval
+}
+
+func (p Poller) timeout(resource string, last string, polled bool) error {
+	if !polled {
+		return fmt.Errorf("%w after %s: %s reported no status", ErrPollTimeout, p.Timeout, resource)
+	}
+	if _, known := p.States[last]; !known {
+		return fmt.Errorf("%w after %s: %s reported %w %q", ErrPollTimeout, p.Timeout, resource, ErrUnknownStatus, last)
+	}
+	return fmt.Errorf("%w after %s: %s still has status %q", ErrPollTimeout, p.Timeout, resource, last)
+}
@@ -0,0 +1,116 @@
+package shared_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/osga1291/upload/shared"
+)
+
+var testPoller = shared.Poller{
+	InitialInterval: time.Millisecond,
+	MaxInterval:     5 * time.Millisecond,
+	Multiplier:      2,
+	Timeout:         100 * time.Millisecond,
+	States: map[string]shared.PollState{
+		"PENDING": shared.PollPending,
+		"DONE":    shared.PollSuccess,
+		"FAILED":  shared.PollFailure,
+	},
+}
+
+// script is a status func reporting each of list in turn and then the last
+// one forever.
+type script struct {
+	list  []string
+	calls int
+}
+
+func statuses(list ...string) *script {
+	return &script{list: list}
+}
+
+func (s *script) status(ctx context.Context) (string, error) {
+	status := s.list[len(s.list)-1]
+	if s.calls < len(s.list) {
+		status = s.list[s.calls]
+	}
+	s.calls++
+	return status, nil
+}
+
+func TestPollerWaitErrors(t *testing.T) {
+	boom := errors.New("boom")
+	tests := []struct {
+		name   string
+		status func(ctx context.Context) (string, error)
+		// is lists the errors the result must match.
+		is  []error
+		err string
+	}{
+		{name: "failure", status: statuses("PENDING", "FAILED").status, is: []error{shared.ErrProcessingFailed}, err: "file has status FAILED"},
+		{name: "still pending", status: statuses("PENDING").status, is: []error{shared.ErrPollTimeout}, err: `still has status "PENDING"`},
+		{name: "unknown status", status: statuses("PENDING", "QUEUED").status, is: []error{shared.ErrPollTimeout, shared.ErrUnknownStatus}, err: `reported unknown status "QUEUED"`},
+		{name: "status error", status: func(ctx context.Context) (string, error) { return "", boom }, is: []error{boom}},
+		{
+			name: "no status before the timeout",
+			status: func(ctx context.Context) (string, error) {
+				<-ctx.Done()
+				return "", ctx.Err()
+			},
+			is:  []error{shared.ErrPollTimeout},
+			err: "reported no status",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := testPoller.Wait(context.Background(), "file", test.status)
+			for _, target := range test.is {
+				if !errors.Is(err, target) {
+					t.Errorf("got %v, want %v", err, target)
+				}
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got %v, want an error with %q", err, test.err)
+			}
+			if errors.Is(err, shared.ErrUnknownStatus) && !errors.Is(err, shared.ErrPollTimeout) {
+				t.Errorf("unknown status reported before the timeout")
+			}
+		})
+	}
+}
+
+func TestPollerWaitSuccess(t *testing.T) {
+	s := statuses("PENDING", "PENDING", "DONE")
+	err := testPoller.Wait(context.Background(), "file", s.status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.calls != 3 {
+		t.Errorf("polled %d times, want 3", s.calls)
+	}
+}
+
+func TestPollerWaitCancelled(t *testing.T) {
+	poller := testPoller
+	poller.InitialInterval = time.Hour
+	poller.Timeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	s := statuses("PENDING")
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := poller.Wait(ctx, "file", s.status)
+	if !errors.Is(err, context.Canceled) || errors.Is(err, shared.ErrPollTimeout) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Wait returned %v after it was cancelled", elapsed)
+	}
+	if s.calls != 1 {
+		t.Errorf("polled %d times, want 1", s.calls)
+	}
+}
@@ -0,0 +1,55 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+)
+
+// bufferPool hands out at most n part buffers of size bytes and blocks once
+// they are all in use, which bounds the memory of an upload. Buffers are
+// allocated the first time they are needed.
+type bufferPool struct {
+	size int64
+	free chan []byte
+}
+
+func newBufferPool(n int, size int64) *bufferPool {
+	p := &bufferPool{size: size, free: make(chan []byte, n)}
+	for i := 0; i < n; i++ {
+		p.free <- nil
+	}
+	return p
+}
+
+func (p *bufferPool) get(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-p.free:
+		if b == nil {
+			b = make([]byte, p.size)
+		}
+		return b[:p.size], nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (p *bufferPool) put(b []byte) {
+	p.free <- b
+}
+
+// partBuffers returns how many part buffers an upload that has to hold its
+// parts in memory may use: one per worker, fewer if MaxMemory requires it.
+func partBuffers(options UploadOptions) (int, error) {
+	n := options.MaxRoutines
+	if options.MaxMemory <= 0 {
+		return n, nil
+	}
+	fit := options.MaxMemory / options.ChunkSize
+	if fit < 1 {
+		return 0, fmt.Errorf("MaxMemory %d is smaller than one part of %d bytes", options.MaxMemory, options.ChunkSize)
+	}
+	if fit < int64(n) {
+		n = int(fit)
+	}
+	return n, nil
+}
@@ -0,0 +1,309 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ProgressEventType string
+
+const (
+	ProgressCreated       ProgressEventType = "created"
+	ProgressPartStarted   ProgressEventType = "part_started"
+	ProgressPartBytes     ProgressEventType = "part_bytes"
+	ProgressPartCompleted ProgressEventType = "part_completed"
+	ProgressPartFailed    ProgressEventType = "part_failed"
+	ProgressAssembling    ProgressEventType = "assembling"
+	ProgressWaiting       ProgressEventType = "waiting"
+	ProgressDone          ProgressEventType = "done"
+)
+
+// ProgressEvent describes a step of an upload together with the totals so
+// far. TotalBytes and TotalParts are 0 when they are not known in advance, as
+// with UploadReader.
+type ProgressEvent struct {
+	Type       ProgressEventType
+	UploadID   string
+	FileID     string
+	PartNumber int
+	Attempt    int
+	BytesSent  int64
+	TotalBytes int64
+	PartsDone  int
+	TotalParts int
+	Elapsed    time.Duration
+	Err        error
+}
+
+// Throughput returns the average upload rate in bytes per second.
+func (e ProgressEvent) Throughput() float64 {
+	if e.Elapsed <= 0 {
+		return 0
+	}
+	return float64(e.BytesSent) / e.Elapsed.Seconds()
+}
+
+// ETA estimates the remaining time from the average throughput, or returns 0
+// when it cannot be estimated.
+func (e ProgressEvent) ETA() time.Duration {
+	rate := e.Throughput()
+	if rate <= 0 || e.TotalBytes <= 0 || e.BytesSent >= e.TotalBytes {
+		return 0
+	}
+	return time.Duration(float64(e.TotalBytes-e.BytesSent) / rate * float64(time.Second))
+}
+
+// ProgressReporter receives the events of an upload. Report is never called
+// concurrently for the same upload.
+type ProgressReporter interface {
+	Report(event ProgressEvent)
+}
+
+// progress tracks the totals of one upload and forwards events to its
+// reporter. A nil *progress ignores every call.
+type progress struct {
+	reporter ProgressReporter
+
+	mutex      sync.Mutex
+	start      time.Time
+	uploadID   string
+	fileID     string
+	totalBytes int64
+	totalParts int
+	partsDone  int
+	sent       int64
+	inFlight   map[int]int64
+}
+
+func newProgress(reporter ProgressReporter) *progress {
+	if reporter == nil {
+		return nil
+	}
+	return &progress{reporter: reporter, start: time.Now(), inFlight: map[int]int64{}}
+}
+
+// report fills in the totals of event and hands it to the reporter. It must be
+// called with p.mutex held.
+func (p *progress) report(event ProgressEvent) {
+	event.UploadID = p.uploadID
+	event.FileID = p.fileID
+	event.BytesSent = p.sent
+	for _, n := range p.inFlight {
+		event.BytesSent += n
+	}
+	event.TotalBytes = p.totalBytes
+	event.PartsDone = p.partsDone
+	event.TotalParts = p.totalParts
+	event.Elapsed = time.Since(p.start)
+	p.reporter.Report(event)
+}
+
+func (p *progress) created(uploadID string, fileID string, totalBytes int64, totalParts int) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.uploadID, p.fileID, p.totalBytes, p.totalParts = uploadID, fileID, totalBytes, totalParts
+	p.report(ProgressEvent{Type: ProgressCreated})
+}
+
+// partStarted resets the bytes counted for an earlier attempt of the part.
+func (p *progress) partStarted(partNumber int, attempt int) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inFlight[partNumber] = 0
+	p.report(ProgressEvent{Type: ProgressPartStarted, PartNumber: partNumber, Attempt: attempt})
+}
+
+func (p *progress) partBytes(partNumber int, n int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inFlight[partNumber] += n
+	p.report(ProgressEvent{Type: ProgressPartBytes, PartNumber: partNumber})
+}
+
+// writer returns the callback that counts the body bytes of a part.
+func (p *progress) writer(partNumber int) func(n int64) {
+	if p == nil {
+		return nil
+	}
+	return func(n int64) { p.partBytes(partNumber, n) }
+}
+
+// restarter returns the callback that discards the bytes counted for a part
+// when its request is sent again.
+func (p *progress) restarter(partNumber int) func() {
+	if p == nil {
+		return nil
+	}
+	return func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.inFlight[partNumber] = 0
+	}
+}
+
+func (p *progress) partCompleted(partNumber int, size int64) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.inFlight, partNumber)
+	p.sent += size
+	p.partsDone++
+	p.report(ProgressEvent{Type: ProgressPartCompleted, PartNumber: partNumber})
+}
+
+func (p *progress) partFailed(partNumber int, attempt int, err error) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.inFlight, partNumber)
+	p.report(ProgressEvent{Type: ProgressPartFailed, PartNumber: partNumber, Attempt: attempt, Err: err})
+}
+
+func (p *progress) step(eventType ProgressEventType, err error) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.report(ProgressEvent{Type: eventType, Err: err})
+}
+
+// countingReader calls onRead with the size of every read from r.
+type countingReader struct {
+	r      io.Reader
+	onRead func(n int64)
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		c.onRead(int64(n))
+	}
+	return n, err
+}
+
+// ProgressBar renders a single line progress bar, redrawn at most every
+// Interval. One ProgressBar can be shared by concurrent uploads.
+type ProgressBar struct {
+	Out      io.Writer
+	Width    int
+	Interval time.Duration
+
+	mutex sync.Mutex
+	last  time.Time
+}
+
+func NewProgressBar(out io.Writer) *ProgressBar {
+	return &ProgressBar{Out: out, Width: 30, Interval: 200 * time.Millisecond}
+}
+
+func (b *ProgressBar) Report(e ProgressEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	final := e.Type == ProgressDone
+	if !final && e.Type == ProgressPartBytes && time.Since(b.last) < b.Interval {
+		return
+	}
+	b.last = time.Now()
+
+	bar := strings.Repeat(" ", b.Width)
+	percent := ""
+	if e.TotalBytes > 0 {
+		filled := int(float64(b.Width) * float64(e.BytesSent) / float64(e.TotalBytes))
+		if filled > b.Width {
+			filled = b.Width
+		}
+		bar = strings.Repeat("=", filled) + strings.Repeat(" ", b.Width-filled)
+		percent = fmt.Sprintf("%3.0f%% ", 100*float64(e.BytesSent)/float64(e.TotalBytes))
+	}
+	parts := fmt.Sprintf("%d", e.PartsDone)
+	if e.TotalParts > 0 {
+		parts = fmt.Sprintf("%d/%d", e.PartsDone, e.TotalParts)
+	}
+	line := fmt.Sprintf("\r[%s] %s%s parts %s/s ETA %s %-12s",
+		bar, percent, parts, formatBytes(e.Throughput()), e.ETA().Round(time.Second), e.Type)
+	if final {
+		if e.Err != nil {
+			line += " " + e.Err.Error()
+		}
+		line += "\n"
+	}
+	fmt.Fprint(b.Out, line)
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+// JSONProgress writes every event except part_bytes as one JSON object per
+// line, which suits CI logs.
+type JSONProgress struct {
+	Out io.Writer
+	// Bytes also writes the part_bytes events.
+	Bytes bool
+}
+
+func (j *JSONProgress) Report(e ProgressEvent) {
+	if e.Type == ProgressPartBytes && !j.Bytes {
+		return
+	}
+	line := struct {
+		Time       time.Time         `json:"time"`
+		Type       ProgressEventType `json:"type"`
+		UploadID   string            `json:"uploadId,omitempty"`
+		FileID     string            `json:"fileId,omitempty"`
+		PartNumber int               `json:"partNumber,omitempty"`
+		Attempt    int               `json:"attempt,omitempty"`
+		BytesSent  int64             `json:"bytesSent"`
+		TotalBytes int64             `json:"totalBytes,omitempty"`
+		PartsDone  int               `json:"partsDone"`
+		TotalParts int               `json:"totalParts,omitempty"`
+		Throughput float64           `json:"bytesPerSecond"`
+		ETA        float64           `json:"etaSeconds,omitempty"`
+		Error      string            `json:"error,omitempty"`
+	}{
+		Time:       time.Now().UTC(),
+		Type:       e.Type,
+		UploadID:   e.UploadID,
+		FileID:     e.FileID,
+		PartNumber: e.PartNumber,
+		Attempt:    e.Attempt,
+		BytesSent:  e.BytesSent,
+		TotalBytes: e.TotalBytes,
+		PartsDone:  e.PartsDone,
+		TotalParts: e.TotalParts,
+		Throughput: e.Throughput(),
+		ETA:        e.ETA().Seconds(),
+	}
+	if e.Err != nil {
+		line.Error = e.Err.Error()
+	}
+	b, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	j.Out.Write(append(b, '\n'))
+}
@@ -0,0 +1,251 @@
+package shared_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/dataocean/dataoceantest"
+	"github.com/osga1291/upload/shared"
+	"github.com/osga1291/upload/shared/sharedtest"
+)
+
+// eventLog is a ProgressReporter that keeps every event.
+type eventLog struct {
+	mutex  sync.Mutex
+	events []shared.ProgressEvent
+}
+
+func (l *eventLog) Report(e shared.ProgressEvent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events = append(l.events, e)
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestProgressRetriedPartCountedOnce(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	// The first PUT of every part is read in full and then answered 503,
+	// which RetryPolicy retries without the part starting over.
+	var mutex sync.Mutex
+	failed := map[string]bool{}
+	do.GetClient().Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mutex.Lock()
+		first := req.Method == "PUT" && !failed[req.URL.Path]
+		failed[req.URL.Path] = true
+		mutex.Unlock()
+		if !first {
+			return http.DefaultTransport.RoundTrip(req)
+		}
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("busy")),
+			Request:    req,
+		}, nil
+	})
+	file, _ := sharedtest.TempFile(t, fileSize)
+	log := &eventLog{}
+
+	_, err := shared.MultipartUpload(do, dataocean.NewFileRequest("/progress/file.bin").Multipart(), nil, file, shared.UploadOptions{ChunkSize: partSize, MaxRoutines: 2, Progress: log})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := log.events[len(log.events)-1]
+	if last.Type != shared.ProgressDone || last.BytesSent != fileSize {
+		t.Errorf("last event %s with %d bytes, want done with %d", last.Type, last.BytesSent, fileSize)
+	}
+	for _, e := range log.events {
+		if e.BytesSent > e.TotalBytes {
+			t.Fatalf("%s event counts %d of %d bytes", e.Type, e.BytesSent, e.TotalBytes)
+		}
+	}
+}
+
+func TestProgressPartWithoutETagNotCompleted(t *testing.T) {
+	server := dataoceantest.NewServer()
+	defer server.Close()
+	do := server.Client()
+	sharedtest.Install(do.GetClient()).On("PUT", part2, sharedtest.Fault{DropHeaders: []string{"Etag"}})
+	file, _ := sharedtest.TempFile(t, fileSize)
+	log := &eventLog{}
+
+	_, err := shared.MultipartUpload(do, dataocean.NewFileRequest("/progress/file.bin").Multipart(), nil, file, shared.UploadOptions{ChunkSize: partSize, MaxRoutines: 2, Progress: log})
+	if !errors.Is(err, shared.ErrInvalidResponse) {
+		t.Fatalf("got %v, want ErrInvalidResponse", err)
+	}
+	failed := 0
+	for _, e := range log.events {
+		if e.PartNumber != 2 {
+			continue
+		}
+		switch e.Type {
+		case shared.ProgressPartCompleted:
+			t.Errorf("part 2 reported completed without an ETag")
+		case shared.ProgressPartFailed:
+			failed++
+		}
+	}
+	last := log.events[len(log.events)-1]
+	if failed != 1 || last.Type != shared.ProgressDone || last.PartsDone != 2 {
+		t.Errorf("part 2 failed %d times, last event %s with %d parts done; want 1 failure and 2 parts done", failed, last.Type, last.PartsDone)
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	var out bytes.Buffer
+	bar := &shared.ProgressBar{Out: &out, Width: 10, Interval: time.Hour}
+	event := shared.ProgressEvent{TotalBytes: 1000, TotalParts: 4, Elapsed: time.Second}
+
+	event.Type = shared.ProgressCreated
+	bar.Report(event)
+	if got := out.String(); got != "\r[          ]   0% 0/4 parts 0.0 B/s ETA 0s created     " {
+		t.Errorf("bar when created is %q", got)
+	}
+
+	// part_bytes events are redrawn at most every Interval, other events
+	// always.
+	out.Reset()
+	event.Type, event.BytesSent = shared.ProgressPartBytes, 100
+	bar.Report(event)
+	if out.Len() != 0 {
+		t.Errorf("bar redrawn within its interval: %q", out.String())
+	}
+	event.Type, event.BytesSent, event.PartsDone = shared.ProgressPartCompleted, 500, 2
+	bar.Report(event)
+	if got := out.String(); got != "\r[=====     ]  50% 2/4 parts 500.0 B/s ETA 1s part_completed" {
+		t.Errorf("bar at 50%% is %q", got)
+	}
+
+	out.Reset()
+	event.Type, event.BytesSent, event.PartsDone, event.Err = shared.ProgressDone, 1000, 4, errors.New("boom")
+	bar.Report(event)
+	if got := out.String(); !strings.HasPrefix(got, "\r[==========] 100% 4/4 parts") || !strings.HasSuffix(got, "done         boom\n") {
+		t.Errorf("final bar is %q", got)
+	}
+}
+
+func TestProgressBarUnknownSize(t *testing.T) {
+	var out bytes.Buffer
+	bar := shared.NewProgressBar(&out)
+	bar.Report(shared.ProgressEvent{Type: shared.ProgressPartCompleted, BytesSent: 2048, PartsDone: 2, Elapsed: time.Second})
+	if got := out.String(); !strings.HasPrefix(got, "\r["+strings.Repeat(" ", 30)+"] 2 parts 2.0 KB/s") {
+		t.Errorf("bar of an upload of unknown size is %q", got)
+	}
+}
+
+func TestProgressBarConcurrentUploads(t *testing.T) {
+	var out bytes.Buffer
+	var mutex sync.Mutex
+	bar := shared.NewProgressBar(writerFunc(func(b []byte) (int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return out.Write(b)
+	}))
+	bar.Interval = 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				bar.Report(shared.ProgressEvent{Type: shared.ProgressPartBytes, BytesSent: int64(n), TotalBytes: 100})
+			}
+		}()
+	}
+	wg.Wait()
+	if n := strings.Count(out.String(), "\r"); n != 800 {
+		t.Errorf("drew %d bars, want 800", n)
+	}
+}
+
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+func TestJSONProgress(t *testing.T) {
+	events := []shared.ProgressEvent{
+		{Type: shared.ProgressCreated, UploadID: "u1", FileID: "f1", TotalBytes: 100, TotalParts: 2},
+		{Type: shared.ProgressPartBytes, UploadID: "u1", FileID: "f1", PartNumber: 1, BytesSent: 10, TotalBytes: 100, TotalParts: 2},
+		{Type: shared.ProgressPartFailed, UploadID: "u1", FileID: "f1", PartNumber: 2, Attempt: 3, BytesSent: 50, TotalBytes: 100, PartsDone: 1, TotalParts: 2, Elapsed: time.Second, Err: errors.New("part 2 failed")},
+		{Type: shared.ProgressDone, UploadID: "u1", FileID: "f1", BytesSent: 100, TotalBytes: 100, PartsDone: 2, TotalParts: 2, Elapsed: 2 * time.Second},
+	}
+	type line struct {
+		Time       time.Time `json:"time"`
+		Type       string    `json:"type"`
+		UploadID   string    `json:"uploadId"`
+		FileID     string    `json:"fileId"`
+		PartNumber int       `json:"partNumber"`
+		Attempt    int       `json:"attempt"`
+		BytesSent  int64     `json:"bytesSent"`
+		TotalBytes int64     `json:"totalBytes"`
+		PartsDone  int       `json:"partsDone"`
+		TotalParts int       `json:"totalParts"`
+		Throughput float64   `json:"bytesPerSecond"`
+		ETA        float64   `json:"etaSeconds"`
+		Error      string    `json:"error"`
+	}
+	decode := func(t *testing.T, out string) []line {
+		t.Helper()
+		var lines []line
+		decoder := json.NewDecoder(strings.NewReader(out))
+		decoder.DisallowUnknownFields()
+		for decoder.More() {
+			var l line
+			err := decoder.Decode(&l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, l)
+		}
+		if strings.Count(out, "\n") != len(lines) {
+			t.Errorf("output is not one object per line: %q", out)
+		}
+		return lines
+	}
+
+	var out bytes.Buffer
+	progress := &shared.JSONProgress{Out: &out}
+	for _, e := range events {
+		progress.Report(e)
+	}
+	lines := decode(t, out.String())
+	if len(lines) != 3 {
+		t.Fatalf("wrote %d lines, want 3 without part_bytes", len(lines))
+	}
+	failed := lines[1]
+	want := line{Time: failed.Time, Type: "part_failed", UploadID: "u1", FileID: "f1", PartNumber: 2, Attempt: 3, BytesSent: 50, TotalBytes: 100, PartsDone: 1, TotalParts: 2, Throughput: 50, ETA: 1, Error: "part 2 failed"}
+	if failed != want {
+		t.Errorf("part_failed line is %+v, want %+v", failed, want)
+	}
+	if failed.Time.IsZero() || lines[2].Type != "done" || lines[2].ETA != 0 {
+		t.Errorf("lines %+v", lines)
+	}
+
+	out.Reset()
+	progress.Bytes = true
+	for _, e := range events {
+		progress.Report(e)
+	}
+	if lines := decode(t, out.String()); len(lines) != 4 || lines[1].Type != "part_bytes" {
+		t.Errorf("with Bytes wrote %+v, want the part_bytes event too", lines)
+	}
+}
@@ -0,0 +1,140 @@
+package shared
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+func UploadReader(service Service, payload Payload, queryParams map[string]string, r io.Reader, options ...UploadOptions) (string, error) {
+	return UploadReaderContext(context.Background(), service, payload, queryParams, r, options...)
+}
+
+// UploadReaderContext uploads the content of r, whose size does not need to be
+// known. It reads the first chunk to choose between a singlepart and a
+// multipart upload and sets the multipart flag of payload to match. Parts are
+// read one after the other into a pool of buffers, one per part in flight, so
+// memory stays within MaxRoutines parts or MaxMemory. Uploads from a reader
+// cannot be journaled.
+func UploadReaderContext(ctx context.Context, service Service, payload Payload, queryParams map[string]string, r io.Reader, options ...UploadOptions) (string, error) {
+	if payload == nil {
+		return "", fmt.Errorf("%w: payload is nil", ErrInvalidPayload)
+	}
+	opts := withDefaults(options...)
+	if opts.Journal != "" {
+		return "", fmt.Errorf("uploads from a reader cannot be journaled")
+	}
+	// Without a ContentLength only the size of the chunks can be checked; the
+	// part count is checked as the parts are read.
+	limits := service.GetPartLimits()
+	opts, err := sizeChunks(opts, limits)
+	if err != nil {
+		return "", err
+	}
+
+	buffers, err := partBuffers(opts)
+	if err != nil {
+		return "", err
+	}
+	pool := newBufferPool(buffers, opts.ChunkSize)
+	first, err := pool.get(ctx)
+	if err != nil {
+		return "", err
+	}
+	n, err := io.ReadFull(r, first)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return singlepartReader(ctx, service, payload, queryParams, first[:n], opts)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// The first chunk is full; one more byte tells whether there is a second.
+	extra := make([]byte, 1)
+	_, err = io.ReadFull(r, extra)
+	if err == io.EOF {
+		return singlepartReader(ctx, service, payload, queryParams, first, opts)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if opts.ChunkSize < limits.MinPartSize {
+		return "", fmt.Errorf("chunk size %d is below the minimum part size %d", opts.ChunkSize, limits.MinPartSize)
+	}
+	payload.SetMultipart(true)
+	id, url, fileId, err := createUpload(ctx, service, payload, queryParams)
+	if err != nil {
+		return "", err
+	}
+	opts.tracker.created(id, fileId, opts.ContentLength, 0)
+	j, err := newJournal("", service, nil, id, fileId, url, opts.ChunkSize, queryParams)
+	if err != nil {
+		return "", abortUpload(service, id, err)
+	}
+	next := readerChunks(ctx, pool, first, io.MultiReader(bytes.NewReader(extra), r), limits.MaxParts)
+	checksum := func() string { return "" }
+	if opts.VerifyChecksum {
+		// The stream is hashed as it is read, so the checksum can only be
+		// compared once the file is available.
+		h := sha256.New()
+		next = hashingSource(next, h)
+		checksum = func() string { return hex.EncodeToString(h.Sum(nil)) }
+	}
+	fileId, err = uploadParts(ctx, service, j, opts, next, checksum)
+	if err != nil {
+		return "", abortUpload(service, id, err)
+	}
+	return fileId, nil
+}
+
+func singlepartReader(ctx context.Context, service Service, payload Payload, queryParams map[string]string, data []byte, options UploadOptions) (string, error) {
+	payload.SetMultipart(false)
+	var sum string
+	if options.VerifyChecksum {
+		h := sha256.Sum256(data)
+		sum = hex.EncodeToString(h[:])
+		if _, ok := service.(ChecksumVerifier); ok {
+			payload.SetChecksum(sum)
+		}
+	}
+	body := io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+	return singlepartUpload(ctx, service, payload, queryParams, body, options, sum)
+}
+
+// readerChunks returns first as part 1 and then reads the following parts
+// from r into buffers taken from pool, failing once there are more than
+// maxParts. Each buffer goes back to the pool when its part is done.
+func readerChunks(ctx context.Context, pool *bufferPool, first []byte, r io.Reader, maxParts int) chunkSource {
+	part := 0
+	return func() (ChunkData, error) {
+		if first != nil {
+			part++
+			b1 := first
+			first = nil
+			return ChunkData{PartNumber: part, Chunk: b1, release: func() { pool.put(b1) }}, nil
+		}
+		b1, err := pool.get(ctx)
+		if err != nil {
+			return ChunkData{}, err
+		}
+		n, err := io.ReadFull(r, b1)
+		if err == io.EOF {
+			pool.put(b1)
+			return ChunkData{}, io.EOF
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			pool.put(b1)
+			return ChunkData{}, err
+		}
+		part++
+		if maxParts > 0 && part > maxParts {
+			pool.put(b1)
+			return ChunkData{}, fmt.Errorf("%w: the stream needs more than %d parts of %d bytes", ErrTooManyParts, maxParts, pool.size)
+		}
+		return ChunkData{PartNumber: part, Chunk: b1[:n], release: func() { pool.put(b1) }}, nil
+	}
+}
@@ -0,0 +1,95 @@
+package shared_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"path"
+	"sync"
+	"testing"
+	"testing/iotest"
+
+	"github.com/osga1291/upload/dataocean"
+	"github.com/osga1291/upload/dataocean/dataoceantest"
+	"github.com/osga1291/upload/shared"
+)
+
+// partRecorder is an http.RoundTripper that records the size of the body of
+// every PUT, by part number.
+type partRecorder struct {
+	base http.RoundTripper
+
+	mutex sync.Mutex
+	sizes map[string]int
+}
+
+func (r *partRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "PUT" && req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.mutex.Lock()
+		r.sizes[path.Base(req.URL.Path)] = len(body)
+		r.mutex.Unlock()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	return r.base.RoundTrip(req)
+}
+
+func TestUploadReader(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		// parts maps the part number to its size; nil means a singlepart
+		// upload.
+		parts map[string]int
+	}{
+		{"empty", 0, nil},
+		{"one byte", 1, nil},
+		{"exactly one chunk", partSize, nil},
+		{"one byte over a chunk", partSize + 1, map[string]int{"1": partSize, "2": 1}},
+		{"short last part", 2*partSize + 12345, map[string]int{"1": partSize, "2": partSize, "3": 12345}},
+		{"whole parts", 3 * partSize, map[string]int{"1": partSize, "2": partSize, "3": partSize}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := dataoceantest.NewServer()
+			defer server.Close()
+			do := server.Client()
+			recorder := &partRecorder{base: http.DefaultTransport, sizes: map[string]int{}}
+			do.GetClient().Transport = recorder
+
+			content := make([]byte, test.size)
+			rand.New(rand.NewSource(int64(test.size))).Read(content)
+			// Neither a Seeker nor a ReaderAt, and returning short reads.
+			r := struct{ io.Reader }{iotest.HalfReader(bytes.NewReader(content))}
+
+			fileId, err := shared.UploadReader(do, dataocean.NewFileRequest("/reader/file.bin"), nil, r, shared.UploadOptions{ChunkSize: partSize, MaxRoutines: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, _ := server.Content(fileId)
+			if !bytes.Equal(stored, content) {
+				t.Errorf("stored %d bytes differing from the %d uploaded", len(stored), len(content))
+			}
+			if test.parts == nil {
+				if len(recorder.sizes) != 1 {
+					t.Errorf("sent %v, want a single PUT", recorder.sizes)
+				}
+				return
+			}
+			if len(recorder.sizes) != len(test.parts) {
+				t.Errorf("sent parts %v, want %v", recorder.sizes, test.parts)
+			}
+			for n, size := range test.parts {
+				if recorder.sizes[n] != size {
+					t.Errorf("part %s has %d bytes, want %d", n, recorder.sizes[n], size)
+				}
+			}
+		})
+	}
+}
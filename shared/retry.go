@@ -0,0 +1,173 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// ErrorClass groups transport errors a RetryPolicy may retry.
+type ErrorClass int
+
+const (
+	ErrorTimeout ErrorClass = 1 << iota
+	ErrorConnectionReset
+	ErrorConnectionRefused
+	ErrorUnexpectedEOF
+)
+
+// RetryPolicy controls how Request retries failed attempts. The zero value
+// makes a single attempt. POST requests, which are not idempotent, are only
+// retried on 429, 503 and errors from before they were sent.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first.
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Jitter is the fraction of each delay, between 0 and 1, that is randomized.
+	Jitter float64
+	// RetryableStatus lists the response status codes that are retried.
+	RetryableStatus map[int]bool
+	// RetryableErrors is the set of transport error classes that are retried.
+	RetryableErrors ErrorClass
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+	Jitter:      0.5,
+	RetryableStatus: map[int]bool{
+		http.StatusTooManyRequests:     true,
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusGatewayTimeout:      true,
+	},
+	RetryableErrors: ErrorTimeout | ErrorConnectionReset | ErrorUnexpectedEOF,
+}
+
+// RequestOptions tunes a single Request.
+type RequestOptions struct {
+	Retry RetryPolicy
+	// Header is added to every attempt.
+	Header http.Header
+	// OnWrite is called with the number of body bytes read by the transport.
+	OnWrite func(n int64)
+	// OnAttempt is called before every attempt, so that what OnWrite counted
+	// for an earlier one can be discarded.
+	OnAttempt func()
+	// Limiter throttles the body to its bandwidth.
+	Limiter *Limiter
+	// Body, when set, is sent instead of the body argument of Request. It is
+	// read from its start on every attempt, so it is never held in memory.
+	Body *io.SectionReader
+}
+
+// ClassifyError reports which error classes err belongs to.
+func ClassifyError(err error) ErrorClass {
+	var class ErrorClass
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() && !errors.Is(err, context.DeadlineExceeded) {
+		class |= ErrorTimeout
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		class |= ErrorConnectionReset
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		class |= ErrorConnectionRefused
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		class |= ErrorUnexpectedEOF
+	}
+	return class
+}
+
+// retryable reports whether a request with method that failed with err, or
+// was answered with status when err is nil, may be sent again. A POST may
+// already have created something, so it is only retried when the server asks
+// for that with 429 or 503, or when it failed before it was sent.
+func (p RetryPolicy) retryable(method string, status int, err error) bool {
+	post := method == http.MethodPost
+	if err != nil {
+		if post && !unsent(err) {
+			return false
+		}
+		return ClassifyError(err)&p.RetryableErrors != 0
+	}
+	if post && status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return false
+	}
+	return p.RetryableStatus[status]
+}
+
+// unsent reports whether err happened while connecting, before any of the
+// request reached the server.
+func unsent(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Backoff returns the delay before the attempt following attempt, growing
+// exponentially from BaseDelay up to MaxDelay.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 && delay > 0 {
+		delay -= time.Duration(rand.Float64() * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// delay returns how long to wait before retrying resp, honoring Retry-After
+// on 429 and 503 responses.
+func (p RetryPolicy) delay(attempt int, resp *http.Response) time.Duration {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return d
+		}
+	}
+	return p.Backoff(attempt)
+}
+
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		d := time.Until(t)
+		if d < 0 {
+			d = 0
+		}
+		return d, true
+	}
+	return 0, false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
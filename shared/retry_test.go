@@ -0,0 +1,128 @@
+package shared
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000, 1000}
+	for i, w := range want {
+		attempt := i + 1
+		if got := p.Backoff(attempt); got != w*time.Millisecond {
+			t.Errorf("Backoff(%d) = %v, want %v", attempt, got, w*time.Millisecond)
+		}
+	}
+
+	// Without MaxDelay the delay keeps doubling.
+	p.MaxDelay = 0
+	if got := p.Backoff(12); got != 100*time.Millisecond<<11 {
+		t.Errorf("uncapped Backoff(12) = %v, want %v", got, 100*time.Millisecond<<11)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 4 * time.Second, Jitter: 0.25}
+	for _, attempt := range []int{1, 2, 5} {
+		full := RetryPolicy{BaseDelay: p.BaseDelay, MaxDelay: p.MaxDelay}.Backoff(attempt)
+		min := full - time.Duration(p.Jitter*float64(full))
+		for i := 0; i < 1000; i++ {
+			got := p.Backoff(attempt)
+			if got < min || got > full {
+				t.Fatalf("Backoff(%d) = %v, want between %v and %v", attempt, got, min, full)
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"120", 120 * time.Second, true},
+		{"-1", 0, false},
+		{"1.5", 0, false},
+		{"soon", 0, false},
+		{now.Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	}
+	for _, test := range tests {
+		got, ok := parseRetryAfter(test.value)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, want %v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+
+	// An HTTP date is a delay from now, to the second.
+	got, ok := parseRetryAfter(now.Add(time.Minute).UTC().Format(http.TimeFormat))
+	if !ok || got <= 58*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter of a date a minute away = %v, %v", got, ok)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	dialTimeout := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{IsTimeout: true}}
+	readTimeout := &net.OpError{Op: "read", Net: "tcp", Err: &net.DNSError{IsTimeout: true}}
+
+	tests := []struct {
+		method string
+		status int
+		err    error
+		want   bool
+	}{
+		{"GET", http.StatusTooManyRequests, nil, true},
+		{"GET", http.StatusInternalServerError, nil, true},
+		{"GET", http.StatusBadGateway, nil, true},
+		{"GET", http.StatusServiceUnavailable, nil, true},
+		{"GET", http.StatusGatewayTimeout, nil, true},
+		{"GET", http.StatusBadRequest, nil, false},
+		{"GET", http.StatusNotFound, nil, false},
+		{"GET", http.StatusNotImplemented, nil, false},
+		{"PUT", http.StatusInternalServerError, nil, true},
+		{"DELETE", http.StatusBadGateway, nil, true},
+		{"POST", http.StatusTooManyRequests, nil, true},
+		{"POST", http.StatusServiceUnavailable, nil, true},
+		{"POST", http.StatusInternalServerError, nil, false},
+		{"POST", http.StatusBadGateway, nil, false},
+		{"POST", http.StatusGatewayTimeout, nil, false},
+
+		{"GET", 0, reset, true},
+		{"GET", 0, io.ErrUnexpectedEOF, true},
+		{"GET", 0, io.EOF, true},
+		{"GET", 0, readTimeout, true},
+		{"GET", 0, dialTimeout, true},
+		{"GET", 0, refused, false},
+		{"GET", 0, context.DeadlineExceeded, false},
+		{"GET", 0, context.Canceled, false},
+		{"GET", 0, errors.New("bad request"), false},
+		{"PUT", 0, reset, true},
+		{"POST", 0, reset, false},
+		{"POST", 0, io.ErrUnexpectedEOF, false},
+		{"POST", 0, readTimeout, false},
+		{"POST", 0, dialTimeout, true},
+		{"POST", 0, refused, false},
+	}
+	for _, test := range tests {
+		if got := DefaultRetryPolicy.retryable(test.method, test.status, test.err); got != test.want {
+			t.Errorf("retryable(%s, %d, %v) = %v, want %v", test.method, test.status, test.err, got, test.want)
+		}
+	}
+
+	// The zero policy retries nothing.
+	if (RetryPolicy{}).retryable("GET", http.StatusServiceUnavailable, nil) || (RetryPolicy{}).retryable("GET", 0, reset) {
+		t.Errorf("zero RetryPolicy retries")
+	}
+}
@@ -0,0 +1,114 @@
+package shared
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Route names every Service resolves with GetUrl.
+const (
+	RouteCreateFile = "createFile"
+	RouteGetFile    = "getFile"
+)
+
+// Route is an endpoint relative to the base URL of a service. Path holds
+// {name} parameters, each replacing one path segment; Query holds the query
+// parameters the endpoint always takes.
+type Route struct {
+	Path  string
+	Query url.Values
+}
+
+// Routes is the route table of a service, by name.
+type Routes map[string]Route
+
+// URL returns the absolute URL of the route called name under baseURL.
+func (r Routes) URL(baseURL string, name string, params map[string]string) (string, error) {
+	route, ok := r[name]
+	if !ok {
+		return "", fmt.Errorf("action %s is not found", name)
+	}
+	if baseURL == "" {
+		return "", fmt.Errorf("no base URL for action %s", name)
+	}
+	path, err := route.expand(params)
+	if err != nil {
+		return "", fmt.Errorf("action %s: %w", name, err)
+	}
+	u := strings.TrimSuffix(baseURL, "/") + path
+	if len(route.Query) > 0 {
+		u += "?" + route.Query.Encode()
+	}
+	return u, nil
+}
+
+// Params returns the names of the parameters in the path of r.
+func (r Route) Params() []string {
+	var names []string
+	rest := r.Path
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			return names
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return names
+		}
+		names = append(names, rest[start+1:start+end])
+		rest = rest[start+end+1:]
+	}
+}
+
+// HasParam reports whether the path of r takes the parameter name.
+func (r Route) HasParam(name string) bool {
+	for _, p := range r.Params() {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// expand replaces every {name} in the path with the path-escaped value of
+// params[name]. Values are never expanded again, and parameters the path does
+// not take are an error, as are missing or empty ones.
+func (r Route) expand(params map[string]string) (string, error) {
+	var b strings.Builder
+	used := map[string]bool{}
+	rest := r.Path
+	for {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			b.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated parameter in route %q", r.Path)
+		}
+		name := rest[start+1 : start+end]
+		value := params[name]
+		if value == "" {
+			return "", fmt.Errorf("missing parameter %s for route %q", name, r.Path)
+		}
+		used[name] = true
+		b.WriteString(rest[:start])
+		b.WriteString(url.PathEscape(value))
+		rest = rest[start+end+1:]
+	}
+
+	var unknown []string
+	for name := range params {
+		if !used[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return "", fmt.Errorf("unknown parameters %s for route %q", strings.Join(unknown, ", "), r.Path)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,74 @@
+package shared_test
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/osga1291/upload/shared"
+)
+
+var testRoutes = shared.Routes{
+	"getFile":      {Path: "/spaces/{spaceId}/files/{fileId}", Query: url.Values{"complete": {"true"}, "status": {"active"}}},
+	"createFolder": {Path: "/folders"},
+	"broken":       {Path: "/files/{fileId"},
+}
+
+func TestRoutesURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		baseURL string
+		route   string
+		params  map[string]string
+		want    string
+		// err is part of the expected error message; empty means none.
+		err string
+	}{
+		{"plain", "https://api.example.com/v1", "createFolder", nil, "https://api.example.com/v1/folders", ""},
+		{"base URL with a trailing slash", "https://api.example.com/v1/", "createFolder", nil, "https://api.example.com/v1/folders", ""},
+		{"params and query", "https://api.example.com", "getFile", map[string]string{"spaceId": "s1", "fileId": "f1"}, "https://api.example.com/spaces/s1/files/f1?complete=true&status=active", ""},
+		{"escaped values", "https://api.example.com", "getFile", map[string]string{"spaceId": "a b", "fileId": "ü%"}, "https://api.example.com/spaces/a%20b/files/%C3%BC%25?complete=true&status=active", ""},
+		{"slash and question mark in an id", "https://api.example.com", "getFile", map[string]string{"spaceId": "a/b", "fileId": "c?d=e"}, "https://api.example.com/spaces/a%2Fb/files/c%3Fd=e?complete=true&status=active", ""},
+		{"parameter name inside a value", "https://api.example.com", "getFile", map[string]string{"spaceId": "spaceId", "fileId": "{spaceId}"}, "https://api.example.com/spaces/spaceId/files/%7BspaceId%7D?complete=true&status=active", ""},
+		{"missing parameter", "https://api.example.com", "getFile", map[string]string{"spaceId": "s1"}, "", "missing parameter fileId"},
+		{"empty parameter", "https://api.example.com", "getFile", map[string]string{"spaceId": "s1", "fileId": ""}, "", "missing parameter fileId"},
+		{"unknown parameter", "https://api.example.com", "getFile", map[string]string{"spaceId": "s1", "fileId": "f1", "folderId": "x"}, "", "unknown parameters folderId"},
+		{"unknown route", "https://api.example.com", "deleteFile", nil, "", "action deleteFile is not found"},
+		{"no base URL", "", "createFolder", nil, "", "no base URL"},
+		{"unterminated parameter", "https://api.example.com", "broken", map[string]string{"fileId": "f1"}, "", "unterminated parameter"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := testRoutes.URL(test.baseURL, test.route, test.params)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %q, %v, want an error with %q", got, err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+			if _, err := url.Parse(got); err != nil {
+				t.Errorf("invalid URL: %v", err)
+			}
+		})
+	}
+}
+
+func TestRouteParams(t *testing.T) {
+	route := testRoutes["getFile"]
+	if got := route.Params(); !reflect.DeepEqual(got, []string{"spaceId", "fileId"}) {
+		t.Errorf("Params() = %v", got)
+	}
+	if !route.HasParam("fileId") || route.HasParam("folderId") {
+		t.Errorf("HasParam is wrong for %q", route.Path)
+	}
+	if got := testRoutes["createFolder"].Params(); got != nil {
+		t.Errorf("Params() of a route without parameters = %v", got)
+	}
+}
@@ -1,13 +1,23 @@
 package shared
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+)
 
 type Service interface {
 	GetClient() *http.Client
+	GetCredentials() CredentialProvider
+	GetRetryPolicy() RetryPolicy
+	GetPartLimits() PartLimits
 	GetUrl(action string, replaceMap map[string]string) (string, error)
 	ExtractCreateFileResp(resp *http.Response) (string, string, string, error)
 	WaitForAvailable(id string) error
+	WaitForAvailableContext(ctx context.Context, id string) error
 	Assemble(id string, parts []AssembleTag) error
+	AssembleContext(ctx context.Context, id string, parts []AssembleTag) error
 	CreateTag(etag string, partNumber int) AssembleTag
-	CheckIfMultipart(payload map[string]interface{}) (bool, error)
+	// WrapPayload adapts an untyped create payload to the Payload of the
+	// Service.
+	WrapPayload(fields map[string]interface{}) Payload
 }
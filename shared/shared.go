@@ -2,14 +2,16 @@ package shared
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,13 +19,6 @@ import (
 	"math/rand"
 )
 
-var (
-	bearerToken string
-	bearerMutex sync.Mutex
-)
-
-var mutex = sync.Mutex{}
-
 type NonBlocking struct {
 	Response   *http.Response
 	Error      error
@@ -43,15 +38,65 @@ func (a *AssembleTag) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// errEmptyPart is reported for a part without content, which the chunk
+// sources never produce.
+var errEmptyPart = errors.New("part is empty")
+
 type ChunkData struct {
 	PartNumber int
 	Chunk      []byte
+
+	// section, when set, is streamed instead of Chunk.
+	section *io.SectionReader
+	// release hands the buffer of Chunk back once the part is done with it.
+	release func()
+}
+
+// body returns a reader over the content of the part positioned at its start.
+func (c ChunkData) body() *io.SectionReader {
+	if c.section != nil {
+		return io.NewSectionReader(c.section, 0, c.section.Size())
+	}
+	return io.NewSectionReader(bytes.NewReader(c.Chunk), 0, int64(len(c.Chunk)))
+}
+
+func (c ChunkData) done() {
+	if c.release != nil {
+		c.release()
+	}
 }
 
 type UploadOptions struct {
 	MaxRoutines   int
 	ChunkSize     int64
 	ContentLength int64
+	// AutoChunkSize grows ChunkSize when needed so the upload fits in the
+	// part limits of the Service.
+	AutoChunkSize bool
+	// Checksum is sent with every part and, for ChecksumMD5, compared with
+	// the part ETag when the Service uses MD5 ETags.
+	Checksum ChecksumAlgorithm
+	// VerifyChecksum computes the SHA-256 of the whole upload, attaches it
+	// to the created file and compares it with the one the Service stores.
+	VerifyChecksum bool
+	// Progress receives the events of the upload.
+	Progress ProgressReporter
+	// Journal is the path of the journal a multipart upload keeps so it can
+	// be resumed with ResumeUpload. No journal is kept when it is empty.
+	Journal string
+	// PartAttempts is how many times a multipart part is sent before it is
+	// reported as a PartError. Each attempt also applies the RetryPolicy of
+	// the Service.
+	PartAttempts int
+	// MaxMemory caps the bytes held in part buffers. Parts of a file are
+	// streamed from disk and need none; uploads from a reader hold up to
+	// MaxRoutines parts, or fewer to stay within MaxMemory. 0 means no cap.
+	MaxMemory int64
+	// Limiter caps the bandwidth and the parts in flight. Pass the same
+	// Limiter to several uploads to give them one shared budget.
+	Limiter *Limiter
+
+	tracker *progress
 }
 
 type UploadStruct struct {
@@ -83,45 +128,15 @@ func GenerateRandomString(n int) string {
 	return string(b)
 }
 
-func fetchBearerToken(client *http.Client) (string, error) {
-	var req *http.Request
-	var err error
-	payload := strings.NewReader("grant_type=client_credentials&scope=oscar-test")
-	req, err = http.NewRequest("POST", "https://stage.id.trimblecloud.com/oauth/token", payload)
-	if err != nil {
-		return "", err
-
-	}
-
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.SetBasicAuth("a46ca581-f699-4b3a-a2c2-0f177015d599", "392d56c82d4e4458a3e6547b4c136db9")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	if resp.StatusCode == http.StatusOK {
-		var result map[string]interface{}
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return "", err
-		}
-		err = json.Unmarshal(bodyBytes, &result)
-		if err != nil {
-			return "", err
-		}
-		return result["access_token"].(string), nil
-
-	}
-
-	return "", fmt.Errorf("Request failed with status: %d", resp.StatusCode)
-
+func Request(client *http.Client, creds CredentialProvider, action string, baseUrl string, body *[]byte, queryParams map[string]string, options ...RequestOptions) (*http.Response, error) {
+	return RequestContext(context.Background(), client, creds, action, baseUrl, body, queryParams, options...)
 }
 
-func Request(client *http.Client, action string, baseUrl string, body *[]byte, queryParams map[string]string) (*http.Response, error) {
-	var req *http.Request
-	var err error
+func RequestContext(ctx context.Context, client *http.Client, creds CredentialProvider, action string, baseUrl string, body *[]byte, queryParams map[string]string, options ...RequestOptions) (*http.Response, error) {
+	var opts RequestOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
 
 	// Parse the base URL
 	parsedURL, err := url.Parse(baseUrl)
@@ -129,241 +144,436 @@ func Request(client *http.Client, action string, baseUrl string, body *[]byte, q
 		return nil, fmt.Errorf("invalid URL: %w", err)
 	}
 
-	// Add query parameters to the URL
+	// Merge the query parameters into those already in the URL, replacing
+	// any with the same name.
 	if queryParams != nil {
 		q := parsedURL.Query()
 		for key, value := range queryParams {
-			q.Add(key, value)
+			q.Set(key, value)
 		}
 		parsedURL.RawQuery = q.Encode()
 	}
 
-	if action == "GET" {
-		req, err = http.NewRequest(action, parsedURL.String(), nil)
+	// A 401 forces one token refresh, which does not count as an attempt; a
+	// second 401 is reported as an AuthError.
+	refreshed := false
+	for attempt := 1; ; attempt++ {
+		if opts.OnAttempt != nil {
+			opts.OnAttempt()
+		}
+		resp, token, err := send(ctx, client, creds, action, parsedURL.String(), body, opts)
+		if err != nil {
+			if ctx.Err() == nil && attempt < opts.Retry.MaxAttempts && opts.Retry.retryable(action, 0, err) {
+				if err := sleep(ctx, opts.Retry.Backoff(attempt)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && creds != nil {
+			bodyBytes, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			creds.Invalidate(token)
+			if !refreshed {
+				refreshed = true
+				attempt--
+				continue
+			}
+			return nil, &AuthError{StatusCode: resp.StatusCode, URL: parsedURL.String(), Body: string(bodyBytes)}
+		}
+
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusPartialContent {
+			bodyBytes, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if attempt < opts.Retry.MaxAttempts && opts.Retry.retryable(action, resp.StatusCode, nil) {
+				if err := sleep(ctx, opts.Retry.delay(attempt, resp)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			return nil, newAPIError(resp, bodyBytes)
+		}
+		return resp, nil
+	}
+}
+
+// send performs a single attempt of a Request and returns the token it used.
+// The body is read from the start on every attempt.
+func send(ctx context.Context, client *http.Client, creds CredentialProvider, action string, url string, body *[]byte, opts RequestOptions) (*http.Response, string, error) {
+	var req *http.Request
+	var err error
+	if action == "GET" || (body == nil && opts.Body == nil) {
+		req, err = http.NewRequestWithContext(ctx, action, url, nil)
+	} else if opts.Body != nil || opts.OnWrite != nil || opts.Limiter != nil {
+		var section *io.SectionReader
+		if opts.Body != nil {
+			// A fresh reader per attempt so a retry starts from the beginning.
+			section = io.NewSectionReader(opts.Body, 0, opts.Body.Size())
+		} else {
+			section = io.NewSectionReader(bytes.NewReader(*body), 0, int64(len(*body)))
+		}
+		r := opts.Limiter.Reader(ctx, section)
+		if opts.OnWrite != nil {
+			r = &countingReader{r: r, onRead: opts.OnWrite}
+		}
+		req, err = http.NewRequestWithContext(ctx, action, url, r)
+		if err == nil {
+			req.ContentLength = section.Size()
+		}
 	} else {
-		req, err = http.NewRequest(action, parsedURL.String(), bytes.NewReader(*body))
+		req, err = http.NewRequestWithContext(ctx, action, url, bytes.NewReader(*body))
 	}
 	if err != nil {
-		return nil, err
-
+		return nil, "", err
+	}
+	for key, values := range opts.Header {
+		req.Header[key] = values
 	}
+
+	var token string
 	if action != "PUT" {
 		req.Header.Set("Content-Type", "application/json")
-		var bearer = "Bearer " + bearerToken
-		req.Header.Add("Authorization", bearer)
+		if creds != nil {
+			token, err = creds.Token(ctx, client)
+			if err != nil {
+				return nil, "", err
+			}
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
 	}
 
 	resp, err := client.Do(req)
-
 	if err != nil {
-		fmt.Println(err)
-		return nil, err
+		return nil, "", err
 	}
+	return resp, token, nil
+}
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted {
-		if resp.StatusCode == http.StatusUnauthorized {
-			mutex.Lock()
-			bearerToken, err = fetchBearerToken(client)
-			mutex.Unlock()
-			if err != nil {
-				return nil, err
-			}
-			return Request(client, action, baseUrl, body, queryParams)
-		}
-		var result map[string]interface{}
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
-		err = json.Unmarshal(bodyBytes, &result)
+func defaultUploadOptions(file *os.File, options ...UploadOptions) (UploadOptions, error) {
+	opts := withDefaults(options...)
+	if opts.ContentLength == 0 {
+		contentLength, err := getFileSize(file)
 		if err != nil {
-			return nil, err
+			return UploadOptions{}, err
 		}
-
-		return nil, fmt.Errorf("Request failed with status: %d, response: %s", resp.StatusCode, string(bodyBytes))
+		opts.ContentLength = contentLength
 	}
-	return resp, nil
+	return opts, nil
 }
 
-func defaultUploadOptions(file *os.File, options ...UploadOptions) (UploadOptions, error) {
-	opts := UploadOptions{
+// withDefaults fills in the options left at their zero value.
+func withDefaults(options ...UploadOptions) UploadOptions {
+	defaults := UploadOptions{
 		MaxRoutines:   2 * runtime.NumCPU(),
 		ChunkSize:     50 * 1024 * 1024, // 50 MB
 		ContentLength: 0,
+		PartAttempts:  3,
 	}
+	opts := defaults
 	if len(options) > 0 {
 		opts = options[0]
 	}
-
-	if opts.ContentLength == 0 {
-		contentLength, err := getFileSize(file)
-		if err != nil {
-			return UploadOptions{}, err
-		}
-		opts.ContentLength = contentLength
+	if opts.MaxRoutines <= 0 {
+		opts.MaxRoutines = defaults.MaxRoutines
 	}
-	return opts, nil
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaults.ChunkSize
+	}
+	if opts.PartAttempts <= 0 {
+		opts.PartAttempts = defaults.PartAttempts
+	}
+	if opts.tracker == nil {
+		opts.tracker = newProgress(opts.Progress)
+	}
+	return opts
 }
 
-func Upload(service Service, payload map[string]interface{}, queryParams map[string]string, file *os.File, options ...UploadOptions) (string, error) {
+func Upload(service Service, payload Payload, queryParams map[string]string, file *os.File, options ...UploadOptions) (string, error) {
+	return UploadContext(context.Background(), service, payload, queryParams, file, options...)
+}
+
+func UploadContext(ctx context.Context, service Service, payload Payload, queryParams map[string]string, file *os.File, options ...UploadOptions) (string, error) {
 	opts, err := defaultUploadOptions(file, options...)
 	if err != nil {
 		return "", err
 	}
 
-	isMulti, error := service.CheckIfMultipart(payload)
-	if error != nil {
-		return "", error
+	if payload == nil {
+		return "", fmt.Errorf("%w: payload is nil", ErrInvalidPayload)
 	}
 
-	if !isMulti {
+	if !payload.IsMultipart() {
 		if opts.ContentLength < opts.ChunkSize {
-			return SinglepartUpload(service, payload, queryParams, file, opts)
+			return SinglepartUploadContext(ctx, service, payload, queryParams, file, opts)
 		} else {
 			return "", fmt.Errorf("content length is greater than chunk size")
 		}
 	} else {
-		return MultipartUpload(service, payload, queryParams, file, opts)
+		return MultipartUploadContext(ctx, service, payload, queryParams, file, opts)
 	}
 }
 
-func CreateFile(service Service, payload map[string]interface{}, url string, queryParams map[string]string) (*http.Response, error) {
+func CreateFile(service Service, payload Payload, url string, queryParams map[string]string) (*http.Response, error) {
+	return CreateFileContext(context.Background(), service, payload, url, queryParams)
+}
+
+func CreateFileContext(ctx context.Context, service Service, payload Payload, url string, queryParams map[string]string) (*http.Response, error) {
 
 	jsonBytes, err := json.Marshal(payload)
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPayload, err)
 	}
 
-	resp, err := Request(service.GetClient(), "POST", url, &jsonBytes, queryParams)
+	resp, err := RequestContext(ctx, service.GetClient(), service.GetCredentials(), "POST", url, &jsonBytes, queryParams, RequestOptions{Retry: service.GetRetryPolicy()})
 
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusCreated {
-		return nil, fmt.Errorf("JSON request failed with status: %d", resp.StatusCode)
+		return nil, NewAPIError(resp)
 	}
 	return resp, nil
 }
 
 func GetFile(service Service, fileId string, queryParams map[string]string) (*http.Response, error) {
+	return GetFileContext(context.Background(), service, fileId, queryParams)
+}
+
+func GetFileContext(ctx context.Context, service Service, fileId string, queryParams map[string]string) (*http.Response, error) {
 
-	url, err := service.GetUrl("getFile", map[string]string{"fileId": fileId})
+	url, err := service.GetUrl(RouteGetFile, map[string]string{"fileId": fileId})
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := Request(service.GetClient(), "GET", url, nil, queryParams)
+	resp, err := RequestContext(ctx, service.GetClient(), service.GetCredentials(), "GET", url, nil, queryParams, RequestOptions{Retry: service.GetRetryPolicy()})
 
 	if err != nil {
 		return nil, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("JSON request failed with status: %d", resp.StatusCode)
+		return nil, NewAPIError(resp)
 	}
 	return resp, nil
 
 }
 
-func SinglepartUpload(service Service, payload map[string]interface{}, queryParams map[string]string, file *os.File, options ...UploadOptions) (string, error) {
+func SinglepartUpload(service Service, payload Payload, queryParams map[string]string, file *os.File, options ...UploadOptions) (string, error) {
+	return SinglepartUploadContext(context.Background(), service, payload, queryParams, file, options...)
+}
+
+func SinglepartUploadContext(ctx context.Context, service Service, payload Payload, queryParams map[string]string, file *os.File, options ...UploadOptions) (string, error) {
 	opts, err := defaultUploadOptions(file, options...)
 	if err != nil {
 		return "", err
 	}
-	var startIndex int64 = 0
-	var endIndex int64 = Min(startIndex+opts.ChunkSize, opts.ContentLength)
-	b1 := make([]byte, endIndex-startIndex)
-
-	_, err = file.ReadAt(b1, startIndex)
+	// The file is streamed from disk rather than read into memory.
+	body := io.NewSectionReader(file, 0, Min(opts.ChunkSize, opts.ContentLength))
+	sum, err := attachChecksum(service, payload, file, opts)
 	if err != nil {
 		return "", err
 	}
+	return singlepartUpload(ctx, service, payload, queryParams, body, opts, sum)
+}
 
-	url, err := service.GetUrl("createFile", nil)
+// singlepartUpload creates a file and sends body to it in a single PUT. A
+// non-empty sum is compared with the checksum the service stores.
+func singlepartUpload(ctx context.Context, service Service, payload Payload, queryParams map[string]string, body *io.SectionReader, options UploadOptions, sum string) (fileId string, err error) {
+	header, md5Hex, err := partChecksum(options.Checksum, io.NewSectionReader(body, 0, body.Size()))
 	if err != nil {
 		return "", err
 	}
-
-	resp, err := CreateFile(service, payload, url, queryParams)
+	id, url, fileId, err := createUpload(ctx, service, payload, queryParams)
 	if err != nil {
 		return "", err
 	}
+	tracker := options.tracker
+	tracker.created(id, fileId, body.Size(), 1)
+	defer func() { tracker.step(ProgressDone, err) }()
 
-	id, url, fileId, err := service.ExtractCreateFileResp(resp)
+	err = options.Limiter.Acquire(ctx)
 	if err != nil {
-		return "", err
+		return "", abortUpload(service, id, err)
 	}
-	_, err = Request(service.GetClient(), "PUT", url, &b1, queryParams)
+	tracker.partStarted(1, 1)
+	resp, err := RequestContext(ctx, service.GetClient(), nil, "PUT", url, nil, queryParams, RequestOptions{Retry: service.GetRetryPolicy(), Header: header, OnWrite: tracker.writer(1), OnAttempt: tracker.restarter(1), Limiter: options.Limiter, Body: body})
+	options.Limiter.Release()
 
 	if err != nil {
-		return "", err
+		tracker.partFailed(1, 1, err)
+		return "", abortUpload(service, id, err)
+	}
+	resp.Body.Close()
+	err = verifyETag(service, 1, resp.Header.Get("Etag"), md5Hex)
+	if err != nil {
+		tracker.partFailed(1, 1, err)
+		return "", abortUpload(service, id, err)
 	}
+	tracker.partCompleted(1, body.Size())
 
-	err = service.WaitForAvailable(id)
+	tracker.step(ProgressWaiting, nil)
+	err = service.WaitForAvailableContext(ctx, id)
 	if err != nil {
-		return "", err
+		return "", abortUpload(service, id, err)
+	}
+	err = verifyChecksum(ctx, service, fileId, sum)
+	if err != nil {
+		return "", abortUpload(service, id, err)
 	}
 	return fileId, nil
 }
 
-func MultipartUpload(service Service, payload map[string]interface{}, queryParams map[string]string, file *os.File, options ...UploadOptions) (string, error) {
+func MultipartUpload(service Service, payload Payload, queryParams map[string]string, file *os.File, options ...UploadOptions) (string, error) {
+	return MultipartUploadContext(context.Background(), service, payload, queryParams, file, options...)
+}
+
+func MultipartUploadContext(ctx context.Context, service Service, payload Payload, queryParams map[string]string, file *os.File, options ...UploadOptions) (string, error) {
 	opts, err := defaultUploadOptions(file, options...)
 	if err != nil {
 		return "", err
 	}
-	url, err := service.GetUrl("createFile", nil)
+	opts, err = sizeChunks(opts, service.GetPartLimits())
 	if err != nil {
 		return "", err
 	}
-	resp, err := CreateFile(service, payload, url, queryParams)
+	sum, err := attachChecksum(service, payload, file, opts)
 	if err != nil {
 		return "", err
 	}
-	id, url, fileId, err := service.ExtractCreateFileResp(resp)
-
+	id, url, fileId, err := createUpload(ctx, service, payload, queryParams)
 	if err != nil {
 		return "", err
 	}
 
-	c := make(chan NonBlocking)
-	nb := []AssembleTag{}
-	var wg sync.WaitGroup
-	wg.Add(1)
+	j, err := newJournal(opts.Journal, service, file, id, fileId, url, opts.ChunkSize, queryParams)
+	if err != nil {
+		return "", abortUpload(service, id, err)
+	}
+	opts.tracker.created(id, fileId, opts.ContentLength, partCount(opts))
+	all := make([]int, partCount(opts))
+	for i := range all {
+		all[i] = i + 1
+	}
+	fileId, err = uploadParts(ctx, service, j, opts, fileChunks(file, opts, all), func() string { return sum })
+	if err != nil && !resumable(j, err) {
+		j.Remove()
+		return "", abortUpload(service, id, err)
+	}
+	return fileId, err
+}
 
-	go func() {
-		handleUpload(service, c, &nb)
-	}()
+// createUpload creates the file described by payload and returns the upload
+// id, the upload URL and the file id.
+func createUpload(ctx context.Context, service Service, payload Payload, queryParams map[string]string) (string, string, string, error) {
+	url, err := service.GetUrl(RouteCreateFile, nil)
+	if err != nil {
+		return "", "", "", err
+	}
+	resp, err := CreateFileContext(ctx, service, payload, url, queryParams)
+	if err != nil {
+		return "", "", "", err
+	}
+	return service.ExtractCreateFileResp(resp)
+}
 
+// uploadParts uploads the parts produced by next for the upload recorded in
+// j, then assembles every part recorded in j and waits for the file. Once the
+// file is available it is verified against the SHA-256 returned by checksum,
+// unless that is empty.
+func uploadParts(ctx context.Context, service Service, j *Journal, opts UploadOptions, next chunkSource, checksum func() string) (fileId string, err error) {
+	defer func() { opts.tracker.step(ProgressDone, err) }()
+
+	// Buffered so workers hand over a finished part without waiting for the
+	// journal to be written.
+	c := make(chan NonBlocking, opts.MaxRoutines)
+	handled := make(chan struct{})
+	var failed []PartError
+	var journalErr error
 	go func() {
-		download(service.GetClient(), c, file, &wg, opts, url)
-
+		failed, journalErr = handleUpload(service, c, j)
+		close(handled)
 	}()
 
-	wg.Wait()
+	err = download(ctx, service, c, opts, j.URL, next)
 	close(c)
+	<-handled
+	if err != nil {
+		return "", err
+	}
+	if journalErr != nil {
+		return "", journalErr
+	}
+	nb := j.completed(service)
+	if len(failed) > 0 {
+		return "", &UploadError{
+			ID:        j.ID,
+			FileID:    j.FileID,
+			URL:       j.URL,
+			Completed: nb,
+			Failed:    failed,
+		}
+	}
 
-	err = service.Assemble(id, nb)
+	opts.tracker.step(ProgressAssembling, nil)
+	err = service.AssembleContext(ctx, j.ID, nb)
 	if err != nil {
 		return "", err
 	}
 
-	err = service.WaitForAvailable(id)
+	opts.tracker.step(ProgressWaiting, nil)
+	err = service.WaitForAvailableContext(ctx, j.ID)
 	if err != nil {
 		return "", err
 	}
 
-	return fileId, nil
+	err = verifyChecksum(ctx, service, j.FileID, checksum())
+	if err != nil {
+		return "", err
+	}
 
+	err = j.Remove()
+	if err != nil {
+		return "", err
+	}
+	return j.FileID, nil
 }
 
-func download(client *http.Client, c chan NonBlocking, file *os.File, wg *sync.WaitGroup, options UploadOptions, url string) error {
-	defer wg.Done()
-	var parts int = int(options.ContentLength/options.ChunkSize) + 1
-	if parts > 1000 {
-		return fmt.Errorf("number of parts is greater than 1000 update chunk size")
+// chunkSource returns the next part to upload, or io.EOF once there are no
+// more parts.
+type chunkSource func() (ChunkData, error)
+
+// fileChunks reads the given parts of file.
+func fileChunks(file *os.File, options UploadOptions, parts []int) chunkSource {
+	next := 0
+	return func() (ChunkData, error) {
+		if next == len(parts) {
+			return ChunkData{}, io.EOF
+		}
+		i := parts[next]
+		next++
+		startIndex := int64(i-1) * options.ChunkSize
+		endIndex := Min(startIndex+options.ChunkSize, options.ContentLength)
+
+		// The part is read by the worker that sends it, straight into the
+		// request body. ReadAt is safe to call concurrently.
+		return ChunkData{
+			PartNumber: i,
+			section:    io.NewSectionReader(file, startIndex, endIndex-startIndex),
+		}, nil
 	}
-	fmt.Printf("Parts %d\n", parts)
+}
+
+// download feeds the parts produced by next to the upload workers. It returns
+// once every worker has exited, with ctx.Err() if ctx was cancelled.
+func download(ctx context.Context, service Service, c chan NonBlocking, options UploadOptions, url string, next chunkSource) error {
 	// Channel for chunks with part numbers
 	chunks := make(chan ChunkData, options.MaxRoutines)
 
@@ -373,28 +583,28 @@ func download(client *http.Client, c chan NonBlocking, file *os.File, wg *sync.W
 		uploadWg.Add(1)
 		go func() {
 			defer uploadWg.Done()
-			upload(client, c, chunks, url)
+			upload(ctx, service, c, chunks, url, options)
 		}()
 	}
 
-	// Read file chunks and send them to the channel
-	for i := 1; i <= parts; i++ {
-		startIndex := int64(i-1) * options.ChunkSize
-		endIndex := Min(startIndex+options.ChunkSize, options.ContentLength)
-
-		// Read the file chunk
-		b1 := make([]byte, endIndex-startIndex)
-		mutex.Lock()
-		_, err := file.ReadAt(b1, startIndex)
-		mutex.Unlock()
+	// Read chunks and send them to the channel
+	var err error
+read:
+	for ctx.Err() == nil {
+		var chunk ChunkData
+		chunk, err = next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
 		if err != nil {
-			log.Panic(err)
+			break
 		}
 
-		// Send a deep copy of the chunk with its part number
-		chunks <- ChunkData{
-			PartNumber: i,
-			Chunk:      append([]byte(nil), b1...), // Deep copy
+		select {
+		case chunks <- chunk:
+		case <-ctx.Done():
+			break read
 		}
 	}
 
@@ -403,27 +613,27 @@ func download(client *http.Client, c chan NonBlocking, file *os.File, wg *sync.W
 
 	// Wait for all uploads to complete
 	uploadWg.Wait()
-	return nil
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
 }
 
-func upload(client *http.Client, c chan NonBlocking, chunks chan ChunkData, url string) {
+func upload(ctx context.Context, service Service, c chan NonBlocking, chunks chan ChunkData, url string, options UploadOptions) {
 	for chunk := range chunks {
-		if len(chunk.Chunk) == 0 {
-			log.Panic("Empty chunk")
-		}
-		mutex.Lock()
-		copyChunk := append([]byte(nil), chunk.Chunk...)
-		resp, err := Request(client, "PUT", strings.Replace(url, "*", strconv.Itoa(chunk.PartNumber), -1), &copyChunk, nil)
-		mutex.Unlock()
-		if err != nil {
-			log.Panic(err)
+		// Drain the remaining chunks without sending them once cancelled.
+		if ctx.Err() != nil {
+			chunk.done()
+			continue
 		}
-
-		fmt.Printf("Request solution: %d\n", resp.StatusCode)
-
-		if resp.StatusCode == http.StatusOK {
-			fmt.Printf("Request: %d\n", chunk.PartNumber)
+		var resp *http.Response
+		var err error
+		if chunk.body().Size() == 0 {
+			err = &PartError{PartNumber: chunk.PartNumber, Err: errEmptyPart}
+		} else {
+			resp, err = putPart(ctx, service, url, chunk, options)
 		}
+		chunk.done()
 
 		c <- NonBlocking{
 			Response:   resp,
@@ -433,23 +643,83 @@ func upload(client *http.Client, c chan NonBlocking, chunks chan ChunkData, url
 	}
 }
 
-func handleUpload(s Service, c chan NonBlocking, nb *[]AssembleTag) error {
+// putPart sends one part with its checksum, retrying it up to PartAttempts
+// times on any failure, including a response without an ETag or with one that
+// does not match the part. A part that still fails is returned as a
+// *PartError; cancellation is returned as is.
+func putPart(ctx context.Context, service Service, url string, chunk ChunkData, options UploadOptions) (*http.Response, error) {
+	policy := service.GetRetryPolicy()
+	partUrl := strings.Replace(url, "*", strconv.Itoa(chunk.PartNumber), -1)
+	partErr := &PartError{PartNumber: chunk.PartNumber}
+	header, md5Hex, err := partChecksum(options.Checksum, chunk.body())
+	if err != nil {
+		partErr.Err = err
+		return nil, partErr
+	}
+	for attempt := 1; attempt <= options.PartAttempts; attempt++ {
+		if attempt > 1 {
+			if err := sleep(ctx, policy.Backoff(attempt-1)); err != nil {
+				return nil, err
+			}
+		}
+		if err := options.Limiter.Acquire(ctx); err != nil {
+			return nil, err
+		}
+		options.tracker.partStarted(chunk.PartNumber, attempt)
+		resp, err := RequestContext(ctx, service.GetClient(), nil, "PUT", partUrl, nil, nil, RequestOptions{Retry: policy, Header: header, OnWrite: options.tracker.writer(chunk.PartNumber), OnAttempt: options.tracker.restarter(chunk.PartNumber), Limiter: options.Limiter, Body: chunk.body()})
+		options.Limiter.Release()
+		status := 0
+		if err == nil {
+			status = resp.StatusCode
+			if etag := resp.Header.Get("Etag"); etag == "" {
+				err = fmt.Errorf("%w: part %d has no ETag", ErrInvalidResponse, chunk.PartNumber)
+			} else {
+				err = verifyETag(service, chunk.PartNumber, etag, md5Hex)
+			}
+			if err == nil {
+				options.tracker.partCompleted(chunk.PartNumber, chunk.body().Size())
+				return resp, nil
+			}
+			resp.Body.Close()
+		}
+		if ctx.Err() != nil {
+			options.tracker.partFailed(chunk.PartNumber, attempt, ctx.Err())
+			return nil, ctx.Err()
+		}
+		partErr.Attempts = attempt
+		partErr.Err = err
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			status = apiErr.StatusCode
+		}
+		partErr.LastStatus = status
+	}
+	options.tracker.partFailed(chunk.PartNumber, partErr.Attempts, partErr)
+	return nil, partErr
+}
+
+// handleUpload records the ETag of every uploaded part in j and returns the
+// parts that failed, and the first error updating j. It drains c until it is
+// closed so the workers never block.
+func handleUpload(s Service, c chan NonBlocking, j *Journal) ([]PartError, error) {
+	var failed []PartError
+	var journalErr error
 	for resp := range c {
 		if resp.Error != nil {
-			return resp.Error
-		} else {
-			if resp.Response.StatusCode == http.StatusOK {
-				etag := resp.Response.Header["Etag"][0]
-				json.Unmarshal([]byte(etag), &etag)
-				fmt.Printf("Etag %s, part_number %d", etag, resp.PartNumber)
-				x := s.CreateTag(etag, resp.PartNumber)
-				mutex.Lock()
-				*nb = append(*nb, x)
-				mutex.Unlock()
-			} else {
-				return resp.Error
+			var partErr *PartError
+			if errors.As(resp.Error, &partErr) {
+				failed = append(failed, *partErr)
 			}
+			continue
+		}
+		resp.Response.Body.Close()
+		etag := resp.Response.Header.Get("Etag")
+		json.Unmarshal([]byte(etag), &etag)
+		err := j.Record(resp.PartNumber, etag)
+		if err != nil && journalErr == nil {
+			journalErr = fmt.Errorf("update journal %s: %w", j.Path(), err)
 		}
 	}
-	return nil
+	sort.Slice(failed, func(i, k int) bool { return failed[i].PartNumber < failed[k].PartNumber })
+	return failed, journalErr
 }
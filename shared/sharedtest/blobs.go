@@ -0,0 +1,218 @@
+package sharedtest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlobsPath is where the fake servers serve their presigned URLs.
+const BlobsPath = "/blobs/"
+
+// Blobs is the object store behind the presigned URLs of the fake servers. A
+// singlepart object is written with one PUT; a multipart one is written in
+// parts that are then assembled. Every URL carries the signature of its
+// object, and requests without it are rejected.
+type Blobs struct {
+	mutex   sync.Mutex
+	objects map[string]*object
+}
+
+type object struct {
+	signature string
+	parts     map[int][]byte
+	content   []byte
+	complete  bool
+}
+
+// Part is a part named in an assemble request.
+type Part struct {
+	PartNumber int
+	Etag       string
+}
+
+func NewBlobs() *Blobs {
+	return &Blobs{objects: map[string]*object{}}
+}
+
+// Create starts the object key and returns its upload URL relative to
+// baseURL. For multipart objects the URL has a "*" in place of the part
+// number.
+func (b *Blobs) Create(baseURL string, key string, multipart bool) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	o := &object{signature: RandomID(8), parts: map[int][]byte{}}
+	b.objects[key] = o
+	if multipart {
+		return fmt.Sprintf("%s%s%s/parts/*?signature=%s", baseURL, BlobsPath, key, o.signature)
+	}
+	return fmt.Sprintf("%s%s%s?signature=%s", baseURL, BlobsPath, key, o.signature)
+}
+
+// DownloadURL returns the URL the content of key is fetched from.
+func (b *Blobs) DownloadURL(baseURL string, key string) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	o, ok := b.objects[key]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s%s%s?signature=%s", baseURL, BlobsPath, key, o.signature)
+}
+
+// Assemble joins the parts of key in the order given, after checking that
+// each was uploaded with the given ETag.
+func (b *Blobs) Assemble(key string, parts []Part) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	o, ok := b.objects[key]
+	if !ok {
+		return fmt.Errorf("no upload %s", key)
+	}
+	if len(parts) == 0 {
+		return fmt.Errorf("no parts to assemble")
+	}
+	sorted := sort.SliceIsSorted(parts, func(i, k int) bool { return parts[i].PartNumber < parts[k].PartNumber })
+	if !sorted {
+		return fmt.Errorf("parts are not in ascending order")
+	}
+	var content bytes.Buffer
+	for _, p := range parts {
+		data, ok := o.parts[p.PartNumber]
+		if !ok {
+			return fmt.Errorf("part %d was not uploaded", p.PartNumber)
+		}
+		if etag := etagOf(data); strings.Trim(p.Etag, `"`) != strings.Trim(etag, `"`) {
+			return fmt.Errorf("part %d has ETag %s, not %s", p.PartNumber, etag, p.Etag)
+		}
+		content.Write(data)
+	}
+	o.content = content.Bytes()
+	o.complete = true
+	return nil
+}
+
+// Content returns the content of key once it is complete.
+func (b *Blobs) Content(key string) ([]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	o, ok := b.objects[key]
+	if !ok || !o.complete {
+		return nil, false
+	}
+	return o.content, true
+}
+
+// Parts returns the numbers of the parts uploaded for key.
+func (b *Blobs) Parts(key string) []int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	o, ok := b.objects[key]
+	if !ok {
+		return nil
+	}
+	parts := make([]int, 0, len(o.parts))
+	for n := range o.parts {
+		parts = append(parts, n)
+	}
+	sort.Ints(parts)
+	return parts
+}
+
+func (b *Blobs) Delete(key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.objects, key)
+}
+
+// ServeHTTP handles PUT and GET requests to the presigned URLs.
+func (b *Blobs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, part, multipart := strings.Cut(strings.TrimPrefix(r.URL.Path, BlobsPath), "/parts/")
+	b.mutex.Lock()
+	o, ok := b.objects[key]
+	b.mutex.Unlock()
+	if !ok || r.URL.Query().Get("signature") != o.signature {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && !multipart:
+		content, ok := b.Content(key)
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, key, time.Time{}, bytes.NewReader(content))
+	case r.Method == http.MethodPut:
+		partNumber := 0
+		if multipart {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 1 {
+				http.Error(w, "InvalidPartNumber", http.StatusBadRequest)
+				return
+			}
+			partNumber = n
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "IncompleteBody", http.StatusBadRequest)
+			return
+		}
+		if !checksumsMatch(r.Header, data) {
+			http.Error(w, "BadDigest", http.StatusBadRequest)
+			return
+		}
+		b.mutex.Lock()
+		if multipart {
+			o.parts[partNumber] = data
+		} else {
+			o.content = data
+			o.complete = true
+		}
+		b.mutex.Unlock()
+		w.Header().Set("ETag", etagOf(data))
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// etagOf returns the quoted hex MD5 of data, as S3 does for a single PUT.
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// checksumsMatch checks the checksum headers the client may send with a part.
+func checksumsMatch(header http.Header, data []byte) bool {
+	if v := header.Get("Content-MD5"); v != "" {
+		sum := md5.Sum(data)
+		if v != base64.StdEncoding.EncodeToString(sum[:]) {
+			return false
+		}
+	}
+	if v := header.Get("x-amz-checksum-sha256"); v != "" {
+		sum := sha256.Sum256(data)
+		if v != base64.StdEncoding.EncodeToString(sum[:]) {
+			return false
+		}
+	}
+	return true
+}
+
+// SHA256 returns the hex SHA-256 of data.
+func SHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,229 @@
+package sharedtest
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Fault is what a FaultTransport does to a request. The fields combine: a
+// fault can delay a request and then answer it with a status, for example.
+type Fault struct {
+	// Block holds the request until Block is closed or the request is
+	// cancelled, so a test can act while the request is in flight.
+	Block <-chan struct{}
+	// Latency delays the request before anything else happens to it.
+	Latency time.Duration
+	// Reset fails the request with a connection reset instead of sending it.
+	Reset bool
+	// Status answers the request with this status instead of sending it.
+	Status int
+	// Header sets these headers on the response, whether it was sent or
+	// answered with Status, such as a wrong "Etag".
+	Header http.Header
+	// Truncate cuts the response body after Truncate bytes, after which
+	// reading it fails with io.ErrUnexpectedEOF. 0 leaves the body alone.
+	Truncate int
+	// DropHeaders removes these headers, such as "Etag", from the response.
+	DropHeaders []string
+}
+
+// FaultTransport is an http.RoundTripper that injects scripted faults into the
+// requests it passes to Base. Faults are attached to routes with On, and each
+// route counts the requests it matches so faults can hit only the Nth one.
+type FaultTransport struct {
+	Base http.RoundTripper
+
+	mutex  sync.Mutex
+	routes []*faultRoute
+}
+
+type faultRoute struct {
+	method  string
+	pattern string
+	nth     map[int]bool
+	fault   Fault
+	count   int
+}
+
+// NewFaultTransport returns a FaultTransport sending requests with base, or
+// with http.DefaultTransport when base is nil.
+func NewFaultTransport(base http.RoundTripper) *FaultTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &FaultTransport{Base: base}
+}
+
+// Install makes client send its requests through a new FaultTransport, which
+// wraps the transport client had.
+func Install(client *http.Client) *FaultTransport {
+	t := NewFaultTransport(client.Transport)
+	client.Transport = t
+	return t
+}
+
+// On injects fault into the requests with method, or any method when it is
+// empty, whose path matches pattern as in path.Match, so "*" stands for one
+// path segment. nth lists the matching requests the fault applies to,
+// counting from 1; without it the fault applies to every one. When several
+// routes match a request, the first one added that applies wins.
+func (t *FaultTransport) On(method string, pattern string, fault Fault, nth ...int) *FaultTransport {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	r := &faultRoute{method: method, pattern: pattern, fault: fault}
+	if len(nth) > 0 {
+		r.nth = map[int]bool{}
+		for _, n := range nth {
+			r.nth[n] = true
+		}
+	}
+	t.routes = append(t.routes, r)
+	return t
+}
+
+// Count returns how many requests matched the route added with method and
+// pattern, faulted or not.
+func (t *FaultTransport) Count(method string, pattern string) int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, r := range t.routes {
+		if r.method == method && r.pattern == pattern {
+			return r.count
+		}
+	}
+	return 0
+}
+
+// Clear removes every route, so later requests pass through untouched.
+func (t *FaultTransport) Clear() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.routes = nil
+}
+
+func (t *FaultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fault, faulted := t.match(req)
+	if !faulted {
+		return t.Base.RoundTrip(req)
+	}
+
+	if fault.Block != nil {
+		select {
+		case <-fault.Block:
+		case <-req.Context().Done():
+			closeBody(req)
+			return nil, req.Context().Err()
+		}
+	}
+	if fault.Latency > 0 {
+		timer := time.NewTimer(fault.Latency)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			closeBody(req)
+			return nil, req.Context().Err()
+		}
+	}
+	if fault.Reset {
+		closeBody(req)
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+
+	var resp *http.Response
+	if fault.Status != 0 {
+		closeBody(req)
+		resp = &http.Response{
+			StatusCode: fault.Status,
+			Status:     http.StatusText(fault.Status),
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader(`{"message":"injected fault"}`)),
+			Request:    req,
+		}
+	} else {
+		var err error
+		resp, err = t.Base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name, values := range fault.Header {
+		resp.Header.Del(name)
+		for _, v := range values {
+			resp.Header.Add(name, v)
+		}
+	}
+	for _, name := range fault.DropHeaders {
+		resp.Header.Del(name)
+	}
+	if fault.Truncate > 0 {
+		resp.Body = &truncatedBody{body: resp.Body, left: fault.Truncate}
+		resp.ContentLength = -1
+	}
+	return resp, nil
+}
+
+// match counts req against every route and returns the fault of the first
+// route that applies to it.
+func (t *FaultTransport) match(req *http.Request) (Fault, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var fault Fault
+	faulted := false
+	for _, r := range t.routes {
+		if r.method != "" && r.method != req.Method {
+			continue
+		}
+		if ok, _ := path.Match(r.pattern, req.URL.Path); !ok {
+			continue
+		}
+		r.count++
+		if !faulted && (r.nth == nil || r.nth[r.count]) {
+			fault, faulted = r.fault, true
+		}
+	}
+	return fault, faulted
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+// truncatedBody returns the first left bytes of body and then
+// io.ErrUnexpectedEOF.
+type truncatedBody struct {
+	body io.ReadCloser
+	left int
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.body.Read(p)
+	b.left -= n
+	if err == io.EOF {
+		// The body was shorter than the cut.
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (b *truncatedBody) Close() error {
+	return b.body.Close()
+}
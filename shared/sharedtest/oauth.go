@@ -0,0 +1,100 @@
+// Package sharedtest provides the pieces the fake backend servers have in
+// common.
+package sharedtest
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenPath is where the fake servers serve their OAuth token endpoint.
+const TokenPath = "/oauth/token"
+
+// OAuth is a fake OAuth token endpoint for the client credentials grant, and
+// the check that the fake APIs use to accept the tokens it issued.
+type OAuth struct {
+	ClientID     string
+	ClientSecret string
+	// TokenLifetime is the expires_in of the issued tokens. Expired tokens
+	// are rejected.
+	TokenLifetime time.Duration
+
+	mutex  sync.Mutex
+	tokens map[string]time.Time
+	issued int
+}
+
+func NewOAuth(clientID string, clientSecret string) *OAuth {
+	return &OAuth{
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		TokenLifetime: time.Hour,
+		tokens:        map[string]time.Time{},
+	}
+}
+
+// ServeHTTP issues a token to a client authenticated with HTTP basic auth.
+func (o *OAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok || id != o.ClientID || secret != o.ClientSecret {
+		WriteJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.FormValue("grant_type") != "client_credentials" {
+		WriteJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	token := RandomID(16)
+	o.mutex.Lock()
+	o.tokens[token] = time.Now().Add(o.TokenLifetime)
+	o.issued++
+	o.mutex.Unlock()
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(o.TokenLifetime.Seconds()),
+	})
+}
+
+// Valid reports whether token was issued and has neither expired nor been
+// revoked.
+func (o *OAuth) Valid(token string) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	expires, ok := o.tokens[token]
+	return ok && time.Now().Before(expires)
+}
+
+// Issued returns how many tokens were issued.
+func (o *OAuth) Issued() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.issued
+}
+
+// RevokeAll invalidates every issued token, as a key rotation would.
+func (o *OAuth) RevokeAll() {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.tokens = map[string]time.Time{}
+}
+
+// Authorize answers 401 to requests without a valid bearer token instead of
+// passing them to next.
+func (o *OAuth) Authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || !o.Valid(token) {
+			WriteJSON(w, http.StatusUnauthorized, map[string]string{"message": "invalid or expired token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,28 @@
+package sharedtest
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TempFile writes size random bytes, the same ones for the same size, to a
+// file that is removed when t ends. It returns the file opened for reading
+// and its content.
+func TempFile(t testing.TB, size int) (*os.File, []byte) {
+	t.Helper()
+	content := make([]byte, size)
+	rand.New(rand.NewSource(int64(size))).Read(content)
+	path := filepath.Join(t.TempDir(), "source")
+	err := os.WriteFile(path, content, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file, content
+}
@@ -0,0 +1,193 @@
+package shared
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchService is a Service backed by a local server whose part PUTs take
+// partLatency, as a real upload over the network would.
+type benchService struct {
+	server *httptest.Server
+}
+
+const partLatency = 10 * time.Millisecond
+
+func newBenchService(tb testing.TB) *benchService {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/parts/") {
+			io.Copy(io.Discard, r.Body)
+			time.Sleep(partLatency)
+			w.Header().Set("Etag", `"`+strings.TrimPrefix(r.URL.Path, "/parts/")+`"`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	tb.Cleanup(server.Close)
+	return &benchService{server: server}
+}
+
+func (s *benchService) GetClient() *http.Client            { return s.server.Client() }
+func (s *benchService) GetCredentials() CredentialProvider { return StaticToken("token") }
+func (s *benchService) GetRetryPolicy() RetryPolicy        { return RetryPolicy{MaxAttempts: 1} }
+func (s *benchService) GetPartLimits() PartLimits          { return PartLimits{} }
+
+func (s *benchService) GetUrl(action string, replaceMap map[string]string) (string, error) {
+	return s.server.URL + "/" + action, nil
+}
+
+func (s *benchService) ExtractCreateFileResp(resp *http.Response) (string, string, string, error) {
+	resp.Body.Close()
+	return "upload", s.server.URL + "/parts/*", "file", nil
+}
+
+func (s *benchService) WaitForAvailable(id string) error { return nil }
+func (s *benchService) WaitForAvailableContext(ctx context.Context, id string) error {
+	return nil
+}
+func (s *benchService) Assemble(id string, parts []AssembleTag) error { return nil }
+func (s *benchService) AssembleContext(ctx context.Context, id string, parts []AssembleTag) error {
+	return nil
+}
+
+func (s *benchService) CreateTag(etag string, partNumber int) AssembleTag {
+	return AssembleTag{Etag: etag, PartNumber: partNumber, EtagTag: "etag", PartTag: "partNumber"}
+}
+
+func (s *benchService) WrapPayload(fields map[string]interface{}) Payload {
+	return &MapPayload{Fields: fields}
+}
+
+// BenchmarkMultipartUpload uploads the same file with a growing number of
+// workers. With parts sent in parallel the throughput scales with MaxRoutines
+// until the server or the disk becomes the bottleneck.
+func BenchmarkMultipartUpload(b *testing.B) {
+	const parts, chunkSize = 32, 256 * 1024
+	file, err := os.CreateTemp(b.TempDir(), "upload")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	_, err = file.Write(make([]byte, parts*chunkSize))
+	if err != nil {
+		b.Fatal(err)
+	}
+	service := newBenchService(b)
+
+	for _, routines := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("MaxRoutines=%d", routines), func(b *testing.B) {
+			b.SetBytes(parts * chunkSize)
+			for i := 0; i < b.N; i++ {
+				_, err := MultipartUpload(service, &MapPayload{}, nil, file, UploadOptions{MaxRoutines: routines, ChunkSize: chunkSize})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// zeros is an endless stream of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// peakHeap samples the heap in use while f runs and returns its maximum.
+func peakHeap(f func()) uint64 {
+	runtime.GC()
+	var peak atomic.Uint64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var m runtime.MemStats
+		ticker := time.NewTicker(2 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&m)
+			if m.HeapInuse > peak.Load() {
+				peak.Store(m.HeapInuse)
+			}
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	f()
+	close(stop)
+	<-sampled
+	return peak.Load()
+}
+
+// BenchmarkUploadMemory uploads 128 MB in 4 MB parts and reports the peak
+// heap. Files are streamed from disk, so their peak does not depend on the
+// part size; readers hold at most MaxRoutines parts, or what MaxMemory allows.
+func BenchmarkUploadMemory(b *testing.B) {
+	const size, chunkSize = 128 * 1024 * 1024, 4 * 1024 * 1024
+	file, err := os.CreateTemp(b.TempDir(), "upload")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	err = file.Truncate(size)
+	if err != nil {
+		b.Fatal(err)
+	}
+	service := newBenchService(b)
+
+	cases := []struct {
+		name   string
+		upload func(options UploadOptions) error
+	}{
+		{"File", func(options UploadOptions) error {
+			_, err := MultipartUpload(service, &MapPayload{}, nil, file, options)
+			return err
+		}},
+		{"Reader", func(options UploadOptions) error {
+			_, err := UploadReader(service, &MapPayload{}, nil, io.LimitReader(zeros{}, size), options)
+			return err
+		}},
+	}
+	for _, c := range cases {
+		for _, options := range []UploadOptions{
+			{MaxRoutines: 4, ChunkSize: chunkSize},
+			{MaxRoutines: 16, ChunkSize: chunkSize},
+			{MaxRoutines: 16, ChunkSize: chunkSize, MaxMemory: 2 * chunkSize},
+		} {
+			name := fmt.Sprintf("%s/MaxRoutines=%d/MaxMemory=%dMB", c.name, options.MaxRoutines, options.MaxMemory>>20)
+			b.Run(name, func(b *testing.B) {
+				b.SetBytes(size)
+				b.ReportAllocs()
+				var peak uint64
+				for i := 0; i < b.N; i++ {
+					p := peakHeap(func() {
+						err := c.upload(options)
+						if err != nil {
+							b.Fatal(err)
+						}
+					})
+					if p > peak {
+						peak = p
+					}
+				}
+				b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+			})
+		}
+	}
+}